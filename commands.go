@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/etrepat/postman/handler"
+	"github.com/etrepat/postman/imap"
+	"github.com/etrepat/postman/oauth"
+	"github.com/etrepat/postman/version"
+	"github.com/etrepat/postman/watch"
+)
+
+// CHECK_TIMEOUT bounds the reachability checks of handlers
+const CHECK_TIMEOUT = 10 * time.Second
+
+// runCommand runs command, instead of watching the mailbox, and returns the
+// exit status of a command which did not fail but for some messages.
+func runCommand(cfg *config, command string) (status int, err error) {
+	status = EXIT_OK
+	switch command {
+	case "check":
+		err = check(cfg)
+	case "mailboxes":
+		err = mailboxes(cfg)
+	case "deliver":
+		err = deliver(cfg)
+	case "backfill":
+		status, err = backfill(cfg)
+	case "auth login":
+		err = authLogin(cfg)
+	case "config print":
+		err = configPrint(cfg)
+	default:
+		err = newFlagsError("Unknown command: \"%s\".", command)
+	}
+
+	return status, err
+}
+
+// check connects and logs in, lists the capabilities of the server, checks
+// that the mailbox exists and that the target of every handler can be
+// reached.
+func check(cfg *config) error {
+	if err := cfg.check(); err != nil {
+		return err
+	} else if err := setupLogger(cfg); err != nil {
+		return err
+	}
+
+	client, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect()
+
+	fmt.Printf("Capabilities: %s\n", strings.Join(client.Capabilities(), " "))
+
+	list, err := client.Mailboxes(cfg.watch.Mailbox)
+	if err != nil {
+		return newError("%s: %s\n", version.App(), err)
+	} else if len(list) == 0 {
+		return newError("%s: mailbox %s does not exist\n", version.App(), cfg.watch.Mailbox)
+	} else if !list[0].Selectable() {
+		return newError("%s: mailbox %s cannot be selected\n", version.App(), cfg.watch.Mailbox)
+	} else if err := client.Status(list[0]); err != nil {
+		return newError("%s: %s\n", version.App(), err)
+	}
+	fmt.Printf("Mailbox %s: %d messages, %d unseen\n", list[0].Name, list[0].Messages, list[0].Unseen)
+
+	ctx, cancel := context.WithTimeout(context.Background(), CHECK_TIMEOUT)
+	defer cancel()
+
+	w, err := watch.New(cfg.watch)
+	if err != nil {
+		return newError("%s: %s\n", version.App(), err)
+	}
+	defer w.Close()
+
+	failed := 0
+	for _, hnd := range w.CheckHandlers(ctx) {
+		status := "ok"
+		if hnd.Err != nil {
+			status = fmt.Sprintf("failed: %s", hnd.Err)
+			failed++
+		}
+		fmt.Printf("Handler %s, %s: %s\n", hnd.Name, hnd.Description, status)
+	}
+
+	if failed > 0 {
+		return newError("%s: %d handler(s) cannot be reached\n", version.App(), failed)
+	}
+
+	return nil
+}
+
+// mailboxes lists the mailboxes of the account, with their attributes and
+// message counts.
+func mailboxes(cfg *config) error {
+	if err := checkConnectionFlags(cfg.watch); err != nil {
+		return err
+	} else if err := setupLogger(cfg); err != nil {
+		return err
+	}
+
+	client, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect()
+
+	list, err := client.Mailboxes("*")
+	if err != nil {
+		return newError("%s: %s\n", version.App(), err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "MAILBOX\tFLAGS\tMESSAGES\tUNSEEN\n")
+	for _, mailbox := range list {
+		messages, unseen := "-", "-"
+		if mailbox.Selectable() {
+			if err := client.Status(mailbox); err != nil {
+				return newError("%s: %s\n", version.App(), err)
+			}
+			messages, unseen = fmt.Sprint(mailbox.Messages), fmt.Sprint(mailbox.Unseen)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", mailbox.Name, strings.Join(mailbox.Flags, " "), messages, unseen)
+	}
+
+	return w.Flush()
+}
+
+// deliver hands the message of the --file option to the delivery chain, as
+// if it had arrived in the mailbox.
+func deliver(cfg *config) error {
+	if cfg.deliverFile == "" {
+		return newFlagsError("Message file must be specified.")
+	} else if err := cfg.check(); err != nil {
+		return err
+	} else if err := setupLogger(cfg); err != nil {
+		return err
+	}
+
+	var raw []byte
+	var err error
+	if cfg.deliverFile == "-" {
+		raw, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		raw, err = ioutil.ReadFile(cfg.deliverFile)
+	}
+	if err != nil {
+		return newError("%s: could not read message: %s\n", version.App(), err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	w, err := watch.New(cfg.watch)
+	if err != nil {
+		return newError("%s: %s\n", version.App(), err)
+	}
+	defer w.Close()
+
+	err = w.Deliver(ctx, handler.NewMessage(raw))
+	if err != nil {
+		return newError("%s: delivery failed: %s\n", version.App(), err)
+	}
+
+	return nil
+}
+
+// backfill delivers the messages already in the mailbox, since the --since
+// date, through the delivery chain. The exit status is EXIT_UNDELIVERED if
+// some message could not be delivered, which a later run tries again.
+func backfill(cfg *config) (int, error) {
+	opts := &watch.BackfillOptions{
+		BatchSize: cfg.backfillBatch,
+		Rate:      cfg.backfillRate,
+		StateFile: cfg.backfillState,
+		DryRun:    cfg.dryRun}
+
+	if cfg.since != "" {
+		since, err := time.Parse("2006-01-02", cfg.since)
+		if err != nil {
+			return EXIT_OK, newFlagsError("Invalid date: \"%s\". Must be formatted as YYYY-MM-DD.", cfg.since)
+		}
+		opts.Since = since
+	}
+	if opts.BatchSize < 1 {
+		return EXIT_OK, newFlagsError("Backfill batch must be positive.")
+	} else if opts.Rate < 0 {
+		return EXIT_OK, newFlagsError("Backfill rate must not be negative.")
+	}
+
+	if err := cfg.check(); err != nil {
+		return EXIT_OK, err
+	} else if err := setupLogger(cfg); err != nil {
+		return EXIT_OK, err
+	}
+	if opts.StateFile == "" {
+		opts.StateFile = watch.DefaultBackfillStateFile(cfg.watch.Username, cfg.watch.Mailbox)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	w, err := watch.New(cfg.watch)
+	if err != nil {
+		return EXIT_OK, newError("%s: %s\n", version.App(), err)
+	}
+	defer w.Close()
+
+	state, err := w.Backfill(ctx, opts)
+	if err != nil {
+		return EXIT_OK, newError("%s: backfill failed: %s\n", version.App(), err)
+	} else if opts.DryRun {
+		return EXIT_OK, nil
+	}
+
+	fmt.Printf("Delivered %d message(s), %d failed. Progress saved in %s\n", state.Delivered, len(state.Failed), opts.StateFile)
+	if ctx.Err() != nil {
+		return EXIT_OK, newError("%s: backfill interrupted, run it again to resume\n", version.App())
+	} else if len(state.Failed) > 0 {
+		printMessage("%s: %d message(s) could not be delivered, run the backfill again to retry them\n", version.App(), len(state.Failed))
+		return EXIT_UNDELIVERED, nil
+	}
+
+	return EXIT_OK, nil
+}
+
+// connect connects and logs in to the IMAP server.
+func connect(cfg *config) (*imap.ImapClient, error) {
+	client := watch.NewClient(cfg.watch)
+
+	fmt.Printf("Connecting to %s (%s) as %s\n", client.Addr(), cfg.watch.TlsMode, cfg.watch.Username)
+	if err := client.Connect(); err != nil {
+		return nil, newError("%s: %s\n", version.App(), err)
+	}
+
+	return client, nil
+}
+
+// authLogin runs the login flow of the OAuth2 provider and stores the token
+// of the user.
+func authLogin(cfg *config) error {
+	wflags := cfg.watch
+	if wflags.OAuthProvider == "" {
+		return newFlagsError("OAuth2 provider must be specified. Should be one of: google, microsoft.")
+	}
+	if err := checkOAuthFlags(wflags); err != nil {
+		return err
+	} else if cfg.oauthFlow != "" && !oauth.FlowValid(cfg.oauthFlow) {
+		return newFlagsError("Unknown OAuth2 flow: \"%s\". Must be one of: device, loopback.", cfg.oauthFlow)
+	}
+
+	config := wflags.OAuthConfig()
+	flow := cfg.oauthFlow
+	if flow == "" {
+		flow = config.DefaultFlow()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	_, err := oauth.Login(ctx, config, flow, wflags.Username, os.Stdout)
+	if err != nil {
+		return newError("%s: OAuth2 login failed: %s\n", version.App(), err)
+	}
+
+	fmt.Printf("Token stored in %s\n", config.TokenFile)
+
+	return nil
+}
+
+// configPrint prints the effective configuration and where each value comes
+// from, then checks it.
+func configPrint(cfg *config) error {
+	if err := cfg.print(os.Stdout); err != nil {
+		return err
+	}
+
+	return cfg.check()
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/etrepat/postman/imap"
+	"github.com/etrepat/postman/oauth"
+	"github.com/etrepat/postman/redact"
+	"github.com/etrepat/postman/secret"
+	"github.com/etrepat/postman/server"
+	"github.com/etrepat/postman/version"
+	"github.com/etrepat/postman/watch"
+	flag "github.com/ogier/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// sources of option values, by increasing precedence
+const (
+	SOURCE_DEFAULT = "default"
+	SOURCE_FILE    = "file"
+	SOURCE_ENV     = "env"
+	SOURCE_FLAG    = "flag"
+)
+
+// ENV_PREFIX prefixes the environment variable of each option, ie:
+// POSTMAN_SMTP_HOST for --smtp-host.
+const ENV_PREFIX = "POSTMAN_"
+
+var (
+	// former names of the environment variables of some options, still
+	// supported
+	envAliases = map[string]string{
+		"POSTMAN_EMAIL":       "user",
+		"POSTMAN_POSTBACKURL": "postback-url",
+		"POSTMAN_ROOMAUTH":    "auth",
+		"POSTMAN_ROOMNAME":    "name",
+		"POSTMAN_ROOMCOLOR":   "color"}
+
+	// defaults of a run configured by environment variables only, as postman
+	// used to be when started without arguments
+	envDefaults = map[string]string{
+		"mode":  "hipchat",
+		"color": "random"}
+
+	// options of the run itself, neither read from the configuration file
+	// nor, but for POSTMAN_CONFIG, from environment variables
+	commandOptions = map[string]bool{
+		"config":  true,
+		"version": true,
+		"file":    true,
+		"since":   true,
+		"dry-run": true}
+
+	// options holding secrets, masked when printed
+	secretOptions = map[string]bool{
+		"password":            true,
+		"smtp-password":       true,
+		"s3-secret-key":       true,
+		"oauth-client-secret": true,
+		"auth":                true,
+		"admin-token":         true}
+
+	// options holding urls, which may embed credentials
+	urlOptions = map[string]bool{
+		"postback-url":  true,
+		"queue-url":     true,
+		"otlp-endpoint": true}
+
+	// options only applied on start, not on reload
+	restartOptions = []string{
+		"host", "port", "ssl", "user", "password", "password-file", "password-command",
+		"auth-mechanism", "auth-identity", "tls-mode", "tls-ca-file", "tls-server-name",
+		"tls-min-version", "tls-pin", "tls-cert", "tls-key", "oauth-provider",
+		"oauth-client-id", "oauth-client-secret", "oauth-tenant", "oauth-token-file",
+		"mailbox", "workers", "prefetch", "order", "poll-interval", "idle-interval", "keepalive", "listen", "admin-token",
+		"ready-idle-cycles", "log-format", "log-body-max", "log-hash-addresses",
+		"otlp-endpoint", "otlp-insecure"}
+)
+
+// config is the configuration of postman: the options of the watch and of
+// the daemon. Each option is a flag, which may also be set by the YAML
+// configuration file or an environment variable.
+type config struct {
+	watch *watch.Flags
+
+	file             string
+	listen           string
+	readyIdleCycles  int
+	adminToken       string
+	logLevel         string
+	logFormat        string
+	logBodyMax       int
+	logHashAddresses bool
+	otlpEndpoint     string
+	otlpInsecure     bool
+	oauthFlow        string
+	printVersion     bool
+	deliverFile      string
+	once             bool
+	since            string
+	dryRun           bool
+	backfillBatch    int
+	backfillRate     float64
+	backfillState    string
+
+	// comma separated lists, split into the watch options once loaded
+	forwardTo   string
+	tlsPins     string
+	concurrency string
+
+	flags *flag.FlagSet
+	// source of the value of each option, ie: "flag" or "env POSTMAN_HOST"
+	sources map[string]string
+	// command to run instead of watching the mailbox
+	args []string
+}
+
+// loadConfig reads the configuration from defaults, the configuration file,
+// environment variables and args, each one overriding the previous ones.
+func loadConfig(args []string) (*config, error) {
+	c := &config{watch: watch.NewFlags(), sources: map[string]string{}}
+	c.flags = c.newFlagSet()
+	c.flags.Parse(args)
+	c.args = c.flags.Args()
+
+	c.flags.VisitAll(func(f *flag.Flag) {
+		c.sources[f.Name] = SOURCE_DEFAULT
+	})
+	c.flags.Visit(func(f *flag.Flag) {
+		c.sources[f.Name] = SOURCE_FLAG
+	})
+
+	if c.sources["config"] != SOURCE_FLAG {
+		if c.file = os.Getenv(envName("config")); c.file != "" {
+			c.sources["config"] = SOURCE_ENV + " " + envName("config")
+		}
+	}
+	if c.file != "" {
+		if err := c.loadFile(c.file); err != nil {
+			return c, err
+		}
+	} else if len(args) == 0 {
+		for name, value := range envDefaults {
+			c.flags.Lookup(name).Value.Set(value)
+		}
+	}
+
+	if err := c.loadEnv(); err != nil {
+		return c, err
+	}
+
+	if err := c.split(); err != nil {
+		return c, err
+	}
+
+	if c.printVersion {
+		return c, newError("%s\n", version.Version())
+	}
+
+	return c, nil
+}
+
+func (c *config) newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(version.App(), flag.ExitOnError)
+	fs.Usage = func() {
+		printMessage("%s", usageMessage(fs))
+	}
+
+	fs.StringVar(&c.file, "config", "", "YAML configuration file, with options as keys. Read again on SIGHUP.")
+	fs.StringVar(&c.deliverFile, "file", "", "(deliver only) Message file (.eml) to deliver, - for stdin.")
+	fs.StringVar(&c.since, "since", "", "(backfill only) Date of the oldest message to deliver, as YYYY-MM-DD. All messages when empty.")
+	fs.BoolVar(&c.dryRun, "dry-run", false, "(backfill only) Log the messages which would be delivered, without delivering them.")
+	fs.StringVarP(&c.watch.Host, "host", "h", "imap.gmail.com", "IMAP server hostname or ip address.")
+	fs.UintVarP(&c.watch.Port, "port", "p", 993, "IMAP server port number. Defaults to 143 or 993 for ssl.")
+	fs.BoolVar(&c.watch.Ssl, "ssl", true, "Enforce a SSL connection. Defaults to true if port is 993.")
+	fs.StringVarP(&c.watch.Username, "user", "U", "", "IMAP login username.")
+	fs.StringVarP(&c.watch.Password, "password", "P", "", "IMAP login password.")
+	fs.StringVar(&c.watch.PasswordFile, "password-file", "", "File holding the IMAP login password, read again on each connection.")
+	fs.StringVar(&c.watch.PasswordCommand, "password-command", "", "Shell command printing the IMAP login password, ie: \"pass show imap\". Run on each connection.")
+	fs.StringVar(&c.watch.AuthMechanism, "auth-mechanism", "", fmt.Sprintf("IMAP authentication mechanism, negotiated when empty. One of: %s.", strings.ToLower(strings.Join(imap.MECHANISMS, ", "))))
+	fs.StringVar(&c.watch.AuthIdentity, "auth-identity", "", "User to act as once logged in, ie: a shared mailbox. Not supported by login and cram-md5 mechanisms.")
+	fs.StringVar(&c.watch.TlsMode, "tls-mode", "", "One of: implicit, starttls, plaintext (localhost only). Defaults to implicit with ssl, starttls otherwise.")
+	fs.StringVar(&c.watch.TlsCAFile, "tls-ca-file", "", "Certificate authorities (PEM) trusted for the IMAP server, instead of the system ones.")
+	fs.StringVar(&c.watch.TlsServerName, "tls-server-name", "", "Name verified against the IMAP server certificate. Defaults to the host.")
+	fs.StringVar(&c.watch.TlsMinVersion, "tls-min-version", "1.2", "Minimum TLS version. One of: 1.0, 1.1, 1.2, 1.3. Defaults to 1.2.")
+	fs.StringVar(&c.tlsPins, "tls-pin", "", "Comma separated sha256/<base64> digests of the public key of the IMAP server certificate, or of an issuer. One must match.")
+	fs.StringVar(&c.watch.TlsCert, "tls-cert", "", "TLS client certificate file (PEM), for the external mechanism.")
+	fs.StringVar(&c.watch.TlsKey, "tls-key", "", "TLS client certificate key file (PEM). Defaults to the certificate file.")
+	fs.StringVar(&c.watch.OAuthProvider, "oauth-provider", "", "Authenticate with OAuth2 access tokens instead of password. One of: google, microsoft.")
+	fs.StringVar(&c.watch.OAuthClientId, "oauth-client-id", "", "(oauth only) OAuth2 client id.")
+	fs.StringVar(&c.watch.OAuthClientSecret, "oauth-client-secret", "", "(oauth only) OAuth2 client secret.")
+	fs.StringVar(&c.watch.OAuthTenant, "oauth-tenant", "common", "(oauth microsoft only) Azure AD tenant. Defaults to \"common\".")
+	fs.StringVar(&c.watch.OAuthTokenFile, "oauth-token-file", oauth.DefaultTokenFile(), "(oauth only) File storing the token obtained by the \"auth login\" command.")
+	fs.StringVar(&c.oauthFlow, "oauth-flow", "", "(auth login only) One of: device, loopback. Defaults to loopback for google, device for microsoft.")
+	fs.StringVarP(&c.watch.Mailbox, "mailbox", "b", "INBOX", "Mailbox to monitor/idle on. Defaults to: \"INBOX\".")
+	fs.StringVarP(&c.watch.Mode, "mode", "m", "", fmt.Sprintf("Mode of delivery, or comma separated chain of modes. Valid delivery modes are: %s.", strings.Join(watch.ValidDeliveryModes(), ", ")))
+	fs.StringVar(&c.watch.PostbackUrl, "postback-url", "", "(postback only) URL to post incoming raw email message data.")
+	fs.BoolVar(&c.watch.PostEncoded, "encode", false, "(postback only) POST messages as form data (x-form-urlencoded). See `parname` fs.")
+	fs.StringVar(&c.watch.PostParamName, "parname", "message", "(postback only) POST parameter name. Defaults to: \"message\".")
+	fs.BoolVarP(&c.printVersion, "version", "v", false, "Outputs the version information.")
+	fs.StringVarP(&c.watch.RoomAuth, "auth", "a", "", "(hipchat only) room authentication token.")
+	fs.StringVarP(&c.watch.RoomName, "name", "n", "", "(hipchat only) room name.")
+	fs.StringVarP(&c.watch.RoomColor, "color", "c", "green", "(hipchat only) room color. Defaults to \"green\".")
+	fs.StringVar(&c.watch.RoomFormat, "room-format", "text", "(hipchat only) notification format, text or html. Html notifications too long for HipChat are sent as text. Defaults to \"text\".")
+	fs.StringVar(&c.watch.SmtpHost, "smtp-host", "", "(forward only) SMTP server hostname or ip address.")
+	fs.UintVar(&c.watch.SmtpPort, "smtp-port", 587, "(forward only) SMTP server port number. Defaults to 587.")
+	fs.StringVar(&c.watch.SmtpUsername, "smtp-user", "", "(forward only) SMTP login username.")
+	fs.StringVar(&c.watch.SmtpPassword, "smtp-password", "", "(forward only) SMTP login password.")
+	fs.StringVar(&c.watch.SmtpTlsMode, "smtp-tls-mode", "", "(forward only) One of: implicit, starttls, plaintext (localhost only). Defaults to implicit on port 465, starttls otherwise.")
+	fs.StringVar(&c.watch.ForwardFrom, "forward-from", "", "(forward only) Sender address of forwarded messages.")
+	fs.StringVar(&c.forwardTo, "forward-to", "", "(forward only) Comma separated list of recipient addresses.")
+	fs.StringVar(&c.watch.ForwardStyle, "forward-style", "inline", "(forward only) One of: inline, attach, redirect. Defaults to \"inline\".")
+	fs.StringVar(&c.watch.ArchivePath, "archive-path", "", "(archive only) Directory where messages are archived.")
+	fs.StringVar(&c.watch.ArchiveFormat, "archive-format", "maildir", "(archive only) One of: maildir, mbox. Defaults to \"maildir\".")
+	fs.StringVar(&c.watch.ArchiveRotate, "archive-rotate", "none", "(archive only) Date based directory rotation. One of: none, daily, monthly.")
+	fs.BoolVar(&c.watch.ArchiveGzip, "archive-gzip", false, "(archive only) Compress mbox files once rotated.")
+	fs.StringVar(&c.watch.ExecCommand, "exec-command", "", "(exec only) Shell command receiving each raw message on stdin.")
+	fs.DurationVar(&c.watch.ExecTimeout, "exec-timeout", time.Minute, "(exec only) Maximum run time of the command. Defaults to 1m.")
+	fs.IntVar(&c.watch.ExecWorkers, "exec-concurrency", 1, "(exec only) Maximum number of commands running at once. Defaults to 1.")
+	fs.StringVar(&c.watch.QueueUrl, "queue-url", "", "(amqp, nats, kafka only) Broker url, or comma separated list of brokers for kafka.")
+	fs.StringVar(&c.watch.QueueTopic, "queue-topic", "", "(amqp, nats, kafka only) AMQP exchange, NATS subject prefix or Kafka topic.")
+	fs.StringVar(&c.watch.QueueKey, "queue-key", "", "(amqp, nats, kafka only) Routing key template, ie: \"mail.{To}\".")
+	fs.StringVar(&c.watch.QueueFormat, "queue-format", "raw", "(amqp, nats, kafka only) One of: raw, json. Defaults to \"raw\".")
+	fs.StringVar(&c.watch.S3Endpoint, "s3-endpoint", "s3.amazonaws.com", "(s3 only) S3 compatible endpoint host[:port]. Defaults to \"s3.amazonaws.com\".")
+	fs.BoolVar(&c.watch.S3Ssl, "s3-ssl", true, "(s3 only) Use https to reach the endpoint. Defaults to true.")
+	fs.StringVar(&c.watch.S3Region, "s3-region", "", "(s3 only) Bucket region.")
+	fs.StringVar(&c.watch.S3AccessKey, "s3-access-key", "", "(s3 only) Access key id.")
+	fs.StringVar(&c.watch.S3SecretKey, "s3-secret-key", "", "(s3 only) Secret access key.")
+	fs.StringVar(&c.watch.S3Bucket, "s3-bucket", "", "(s3 only) Bucket where messages and attachments are stored.")
+	fs.UintVar(&c.watch.Retries, "retries", 3, "Number of retries of temporary delivery failures. Defaults to 3.")
+	fs.DurationVar(&c.watch.RetryDelay, "retry-delay", 30*time.Second, "Delay before retrying a temporary delivery failure, doubled on each retry. Defaults to 30s.")
+	fs.DurationVar(&c.watch.HandlerTimeout, "handler-timeout", 0, "Maximum duration of a single delivery attempt, 0 for no limit.")
+	fs.DurationVar(&c.watch.MessageTimeout, "message-timeout", 0, "Maximum duration of the delivery of a message, retries included, 0 for no limit.")
+	fs.DurationVar(&c.watch.StopTimeout, "stop-timeout", 30*time.Second, "On shutdown, time given to in-flight deliveries before cancelling them. Defaults to 30s.")
+	fs.IntVar(&c.watch.Workers, "workers", 4, "Number of messages delivered at once. Defaults to 4.")
+	fs.IntVar(&c.watch.Prefetch, "prefetch", 10, "Number of messages fetched ahead of delivery. Defaults to 10.")
+	fs.StringVar(&c.watch.Order, "order", "none", "Deliver messages of a same sender or thread in order. One of: none, sender, thread.")
+	fs.BoolVar(&c.once, "once", false, "Deliver the unseen messages, then exit. Exit status is 1 on IMAP failure, 3 if some message could not be delivered.")
+	fs.DurationVar(&c.watch.PollInterval, "poll-interval", time.Minute, "Interval between checks for new messages when the IMAP server does not support IDLE. Defaults to 1m.")
+	fs.DurationVar(&c.watch.IdleInterval, "idle-interval", imap.IdleTimeout, fmt.Sprintf("Interval after which the IDLE command is renewed, at most %s. Defaults to %s.", imap.MaxIdleInterval, imap.IdleTimeout))
+	fs.DurationVar(&c.watch.KeepAlive, "keepalive", 0, "Interval of NOOP commands sent while idling, for NAT gateways and firewalls dropping quiet connections. Disabled when 0.")
+	fs.IntVar(&c.backfillBatch, "backfill-batch", watch.DEFAULT_BACKFILL_BATCH, fmt.Sprintf("(backfill only) Number of messages fetched at once. Defaults to %d.", watch.DEFAULT_BACKFILL_BATCH))
+	fs.Float64Var(&c.backfillRate, "backfill-rate", watch.DEFAULT_BACKFILL_RATE, fmt.Sprintf("(backfill only) Maximum number of messages delivered per second, 0 for no limit. Defaults to %d.", watch.DEFAULT_BACKFILL_RATE))
+	fs.StringVar(&c.backfillState, "backfill-state", "", "(backfill only) File where the progress is saved, and resumed from. Defaults to backfill-<user>-<mailbox>.json in the user configuration directory.")
+	fs.StringVar(&c.listen, "listen", "0.0.0.0:4000", "Address of the /healthz, /readyz and /metrics http server. Defaults to \"0.0.0.0:4000\".")
+	fs.StringVar(&c.logLevel, "log-level", "info", "One of: debug, info, warn, error. Defaults to \"info\".")
+	fs.StringVar(&c.logFormat, "log-format", "text", "One of: text (logfmt), json. Defaults to \"text\".")
+	fs.IntVar(&c.logBodyMax, "log-body-max", redact.DEFAULT_MAX_BODY_LENGTH, fmt.Sprintf("Maximum length of message bodies logged at debug level, 0 for no limit. Defaults to %d.", redact.DEFAULT_MAX_BODY_LENGTH))
+	fs.BoolVar(&c.logHashAddresses, "log-hash-addresses", false, "Replace email addresses with a digest in logs.")
+	fs.StringVar(&c.otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector host:port or url receiving traces. Disabled when empty, unless OTEL_EXPORTER_OTLP_ENDPOINT is set.")
+	fs.BoolVar(&c.otlpInsecure, "otlp-insecure", false, "Send traces over plain http.")
+	fs.StringVar(&c.adminToken, "admin-token", "", "Bearer token of the /admin/ http api, disabled when empty.")
+	fs.IntVar(&c.readyIdleCycles, "ready-idle-cycles", server.DefaultIdleCycles, fmt.Sprintf("Not ready once this many IDLE intervals elapse without a successful IDLE. Defaults to %d.", server.DefaultIdleCycles))
+	fs.StringVar(&c.concurrency, "handler-concurrency", "", "Comma separated mode=limit list of maximum concurrent deliveries, ie: \"postback=2,s3=8\".")
+
+	return fs
+}
+
+// set sets the option name from source, unless given as a flag.
+func (c *config) set(name string, value string, source string) error {
+	if c.sources[name] == SOURCE_FLAG {
+		return nil
+	}
+	if err := c.flags.Set(name, value); err != nil {
+		return err
+	}
+	c.sources[name] = source
+
+	return nil
+}
+
+// loadFile sets the options of the YAML configuration file at path. Lists
+// may be given as sequences, and mode=limit lists as mappings.
+func (c *config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return newFlagsError("Could not read configuration file: %s.", err)
+	}
+
+	options := map[string]yaml.Node{}
+	if err := yaml.Unmarshal(data, &options); err != nil {
+		return newFlagsError("Invalid configuration file %s: %s.", path, err)
+	}
+
+	names := []string{}
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if commandOptions[name] || c.flags.Lookup(name) == nil {
+			return newFlagsError("Unknown option in configuration file %s: \"%s\".", path, name)
+		}
+		node := options[name]
+		if err := c.set(name, nodeValue(&node), SOURCE_FILE+" "+path); err != nil {
+			return newFlagsError("Invalid value of \"%s\" in configuration file %s: %s.", name, path, err)
+		}
+	}
+
+	return nil
+}
+
+// nodeValue returns the option value of a YAML node: scalars as is, items
+// of sequences and key=value pairs of mappings comma separated.
+func nodeValue(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		items := []string{}
+		for _, item := range node.Content {
+			items = append(items, nodeValue(item))
+		}
+		return strings.Join(items, ",")
+	case yaml.MappingNode:
+		pairs := []string{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			pairs = append(pairs, node.Content[i].Value+"="+nodeValue(node.Content[i+1]))
+		}
+		return strings.Join(pairs, ",")
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return ""
+		}
+	}
+
+	return node.Value
+}
+
+// loadEnv sets the options of their environment variables, or of the files
+// named by the variables with the _FILE suffix.
+func (c *config) loadEnv() error {
+	envs := map[string]string{}
+	c.flags.VisitAll(func(f *flag.Flag) {
+		if !commandOptions[f.Name] {
+			envs[envName(f.Name)] = f.Name
+		}
+	})
+
+	// former names first, so that current ones win
+	if err := c.setEnv(envAliases); err != nil {
+		return err
+	} else if err := c.setEnv(envs); err != nil {
+		return err
+	}
+
+	if port := os.Getenv("PORT0"); port != "" && os.Getenv(envName("listen")) == "" {
+		return c.set("listen", fmt.Sprintf("0.0.0.0:%s", port), SOURCE_ENV+" PORT0")
+	}
+
+	return nil
+}
+
+// setEnv sets the options of envs, by environment variable, which are set.
+func (c *config) setEnv(envs map[string]string) error {
+	names := []string{}
+	for env := range envs {
+		names = append(names, env)
+	}
+	sort.Strings(names)
+
+	for _, env := range names {
+		value, ok, err := c.lookupEnv(env)
+		if err != nil {
+			return newFlagsError("%s.", err)
+		} else if !ok {
+			continue
+		}
+
+		source := SOURCE_ENV + " " + env
+		if _, set := os.LookupEnv(env); !set {
+			source += secret.FILE_SUFFIX
+		}
+		if err := c.set(envs[env], value, source); err != nil {
+			return newFlagsError("Invalid value of %s: %s.", env, err)
+		}
+	}
+
+	return nil
+}
+
+// lookupEnv returns the value of the environment variable env, or of the
+// file named by env with the _FILE suffix. That suffix is left to options
+// ending in -file, ie: POSTMAN_PASSWORD_FILE sets --password-file rather
+// than the password itself.
+func (c *config) lookupEnv(env string) (string, bool, error) {
+	fileOption := false
+	c.flags.VisitAll(func(f *flag.Flag) {
+		fileOption = fileOption || envName(f.Name) == env+secret.FILE_SUFFIX
+	})
+	if fileOption {
+		value, ok := os.LookupEnv(env)
+		return value, ok, nil
+	}
+
+	return secret.LookupEnv(env)
+}
+
+// envName returns the environment variable of the option name.
+func envName(name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// split sets the list options of the watch.
+func (c *config) split() error {
+	for _, rcpt := range strings.Split(c.forwardTo, ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+			c.watch.ForwardTo = append(c.watch.ForwardTo, rcpt)
+		}
+	}
+
+	for _, pin := range strings.Split(c.tlsPins, ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			c.watch.TlsPins = append(c.watch.TlsPins, pin)
+		}
+	}
+
+	c.watch.Concurrency = map[string]int{}
+	for _, limit := range strings.Split(c.concurrency, ",") {
+		if limit = strings.TrimSpace(limit); limit == "" {
+			continue
+		}
+		parts := strings.SplitN(limit, "=", 2)
+		n, err := strconv.Atoi(strings.TrimSpace(parts[len(parts)-1]))
+		if len(parts) != 2 || err != nil || n < 1 {
+			return newFlagsError("Invalid handler concurrency: \"%s\". Must be formatted as mode=limit.", limit)
+		}
+		c.watch.Concurrency[strings.TrimSpace(parts[0])] = n
+	}
+
+	return nil
+}
+
+// check validates the whole configuration, before anything starts or is
+// reloaded.
+func (c *config) check() error {
+	if err := checkFlags(c.watch); err != nil {
+		return err
+	}
+
+	if err := watch.CheckChain(c.watch); err != nil {
+		return newFlagsError("%s.", err)
+	}
+
+	if _, err := parseLogLevel(c.logLevel); err != nil {
+		return err
+	} else if !logFormatValid(c.logFormat) {
+		return newFlagsError("Unknown log format: \"%s\". Must be one of: text, json.", c.logFormat)
+	} else if c.oauthFlow != "" && !oauth.FlowValid(c.oauthFlow) {
+		return newFlagsError("Unknown OAuth2 flow: \"%s\". Must be one of: device, loopback.", c.oauthFlow)
+	}
+
+	return nil
+}
+
+// restartChanges returns the options only applied on start whose value
+// differs in next.
+func (c *config) restartChanges(next *config) []string {
+	changed := []string{}
+	for _, name := range restartOptions {
+		if c.flags.Lookup(name).Value.String() != next.flags.Lookup(name).Value.String() {
+			changed = append(changed, name)
+		}
+	}
+
+	return changed
+}
+
+// print writes the options, secrets masked, along with the source of their
+// value.
+func (c *config) print(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "OPTION\tVALUE\tSOURCE\n")
+	c.flags.VisitAll(func(f *flag.Flag) {
+		if commandOptions[f.Name] && f.Name != "config" {
+			return
+		}
+		value := redactOption(f.Name, f.Value.String())
+		if value == "" {
+			value = `""`
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.Name, value, c.sources[f.Name])
+	})
+
+	return w.Flush()
+}
+
+// redactOption masks secrets and the credentials of urls in the value of the
+// option name.
+func redactOption(name string, value string) string {
+	if secretOptions[name] {
+		return redact.Secret(value)
+	} else if !urlOptions[name] {
+		return value
+	}
+
+	urls := strings.Split(value, ",")
+	for i, u := range urls {
+		if strings.Contains(u, "://") {
+			urls[i] = redact.URL(u)
+		}
+	}
+
+	return strings.Join(urls, ",")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes a YAML configuration file holding content.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "postman.yml")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write configuration file: %s", err)
+	}
+
+	return file
+}
+
+// TestLoadConfigPrecedence checks that flags override environment variables,
+// which override the configuration file, which overrides defaults.
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       bool
+		env        bool
+		flag       bool
+		want       string
+		wantSource string
+	}{
+		{name: "default", want: "", wantSource: SOURCE_DEFAULT},
+		{name: "file", file: true, want: "file.example.com", wantSource: SOURCE_FILE},
+		{name: "env", env: true, want: "env.example.com", wantSource: SOURCE_ENV + " POSTMAN_SMTP_HOST"},
+		{name: "file and env", file: true, env: true, want: "env.example.com", wantSource: SOURCE_ENV + " POSTMAN_SMTP_HOST"},
+		{name: "env and flag", env: true, flag: true, want: "flag.example.com", wantSource: SOURCE_FLAG},
+		{name: "all", file: true, env: true, flag: true, want: "flag.example.com", wantSource: SOURCE_FLAG},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{}
+			if tt.file {
+				args = append(args, "--config="+writeConfigFile(t, "smtp-host: file.example.com\nsmtp-port: 2525\n"))
+			}
+			if tt.env {
+				t.Setenv("POSTMAN_SMTP_HOST", "env.example.com")
+			}
+			if tt.flag {
+				args = append(args, "--smtp-host=flag.example.com")
+			}
+
+			c, err := loadConfig(args)
+			if err != nil {
+				t.Fatalf("loadConfig(%q) error = %v", args, err)
+			}
+			if c.watch.SmtpHost != tt.want {
+				t.Errorf("SmtpHost = %q, want %q", c.watch.SmtpHost, tt.want)
+			}
+			if !strings.HasPrefix(c.sources["smtp-host"], tt.wantSource) {
+				t.Errorf("source of smtp-host = %q, want %q", c.sources["smtp-host"], tt.wantSource)
+			}
+
+			// options only set by the file keep its value
+			if wantPort := map[bool]uint{false: 587, true: 2525}[tt.file]; c.watch.SmtpPort != wantPort {
+				t.Errorf("SmtpPort = %d, want %d", c.watch.SmtpPort, wantPort)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFormerEnv(t *testing.T) {
+	t.Setenv("POSTMAN_EMAIL", "support@example.com")
+	t.Setenv("POSTMAN_USER", "")
+	t.Setenv("POSTMAN_ROOMNAME", "Support")
+	t.Setenv("POSTMAN_NAME", "Helpdesk")
+
+	c, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	// current names win over former ones, when set
+	if c.watch.Username != "" {
+		t.Errorf("Username = %q, want the empty POSTMAN_USER", c.watch.Username)
+	}
+	if c.watch.RoomName != "Helpdesk" {
+		t.Errorf("RoomName = %q, want %q", c.watch.RoomName, "Helpdesk")
+	}
+}
+
+// TestLoadConfigEnvDefaults checks that runs configured by environment
+// variables only keep the defaults they had before options could be given
+// as environment variables.
+func TestLoadConfigEnvDefaults(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		file      bool
+		env       map[string]string
+		wantMode  string
+		wantColor string
+	}{
+		{
+			name:      "environment only",
+			env:       map[string]string{"POSTMAN_ROOMAUTH": "token", "POSTMAN_ROOMNAME": "Support"},
+			wantMode:  "hipchat",
+			wantColor: "random",
+		},
+		{
+			name:      "environment only, with mode and color",
+			env:       map[string]string{"POSTMAN_MODE": "postback", "POSTMAN_ROOMCOLOR": "red"},
+			wantMode:  "postback",
+			wantColor: "red",
+		},
+		{
+			name:      "arguments",
+			args:      []string{"--user=support@example.com"},
+			wantMode:  "",
+			wantColor: "green",
+		},
+		{
+			name:      "configuration file",
+			file:      true,
+			wantMode:  "logger",
+			wantColor: "green",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for env, value := range tt.env {
+				t.Setenv(env, value)
+			}
+			if tt.file {
+				t.Setenv("POSTMAN_CONFIG", writeConfigFile(t, "mode: logger\n"))
+			}
+
+			c, err := loadConfig(tt.args)
+			if err != nil {
+				t.Fatalf("loadConfig(%q) error = %v", tt.args, err)
+			}
+			if c.watch.Mode != tt.wantMode || c.watch.RoomColor != tt.wantColor {
+				t.Errorf("Mode, RoomColor = %q, %q, want %q, %q", c.watch.Mode, c.watch.RoomColor, tt.wantMode, tt.wantColor)
+			}
+		})
+	}
+}
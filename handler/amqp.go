@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/etrepat/postman/redact"
+	"github.com/streadway/amqp"
+)
+
+// AmqpPublisher publishes payloads to a RabbitMQ exchange, waiting for
+// publisher confirms.
+type AmqpPublisher struct {
+	Url      string
+	Exchange string
+
+	mu       sync.Mutex
+	conn     *amqp.Connection
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	closed   bool
+}
+
+func (p *AmqpPublisher) Publish(ctx context.Context, key string, payload []byte, headers map[string]string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.connect(); err != nil {
+		return Temporary(fmt.Errorf("Could not connect to AMQP broker: %s", err))
+	}
+
+	table := amqp.Table{}
+	for k, v := range headers {
+		table[k] = v
+	}
+
+	err := p.channel.Publish(p.Exchange, key, true, false, amqp.Publishing{
+		Headers:      table,
+		ContentType:  headers["Content-Type"],
+		MessageId:    headers["Message-Id"],
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         payload})
+	if err != nil {
+		p.close()
+		return Temporary(fmt.Errorf("AMQP publish failed: %s", err))
+	}
+
+	var confirm amqp.Confirmation
+	var ok bool
+	select {
+	case confirm, ok = <-p.confirms:
+	case <-ctx.Done():
+		// the pending confirm would be mistaken for the next publish one
+		p.close()
+		return ctx.Err()
+	}
+	if !ok {
+		p.close()
+		return Temporary(fmt.Errorf("AMQP channel closed before publish was confirmed"))
+	}
+	if !confirm.Ack {
+		return Temporary(fmt.Errorf("AMQP broker refused message (delivery tag %d)", confirm.DeliveryTag))
+	}
+
+	// the broker sends back unroutable messages before confirming them
+	select {
+	case ret := <-p.returns:
+		return fmt.Errorf("AMQP broker could not route message with key %q: %s", ret.RoutingKey, ret.ReplyText)
+	default:
+	}
+
+	return nil
+}
+
+func (p *AmqpPublisher) Describe() string {
+	return fmt.Sprintf("AmqpHandler (url=%s, exchange=%s)", redact.URL(p.Url), p.Exchange)
+}
+
+// Check connects to the broker, unless already connected.
+func (p *AmqpPublisher) Check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.connect()
+}
+
+// Close closes the connection to the broker, for good.
+func (p *AmqpPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.close()
+
+	return nil
+}
+
+func (p *AmqpPublisher) connect() error {
+	if p.closed {
+		return fmt.Errorf("publisher closed")
+	} else if p.channel != nil {
+		return nil
+	}
+
+	conn, err := amqp.Dial(p.Url)
+	if err != nil {
+		return err
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if err = channel.Confirm(false); err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.conn = conn
+	p.channel = channel
+	p.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	p.returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	return nil
+}
+
+func (p *AmqpPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn, p.channel, p.confirms, p.returns = nil, nil, nil, nil
+}
+
+func NewAmqpPublisher(url string, exchange string) *AmqpPublisher {
+	return &AmqpPublisher{
+		Url:      url,
+		Exchange: exchange}
+}
+
+func NewAmqpHandler(url string, exchange string, keyTemplate string, format string) *QueueHandler {
+	return NewQueueHandler(NewAmqpPublisher(url, exchange), keyTemplate, format)
+}
@@ -0,0 +1,332 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ARCHIVE_FORMAT_MAILDIR = "maildir"
+	ARCHIVE_FORMAT_MBOX    = "mbox"
+
+	ARCHIVE_ROTATE_NONE    = "none"
+	ARCHIVE_ROTATE_DAILY   = "daily"
+	ARCHIVE_ROTATE_MONTHLY = "monthly"
+
+	archiveMboxName = "postman.mbox"
+)
+
+var (
+	ARCHIVE_FORMATS = map[string]bool{
+		ARCHIVE_FORMAT_MAILDIR: true,
+		ARCHIVE_FORMAT_MBOX:    true}
+
+	ARCHIVE_ROTATIONS = map[string]string{
+		ARCHIVE_ROTATE_NONE:    "",
+		ARCHIVE_ROTATE_DAILY:   "2006-01-02",
+		ARCHIVE_ROTATE_MONTHLY: "2006-01"}
+
+	// mboxrd escaping: any line matching ^>*From gets one more '>'
+	mboxFromLine = regexp.MustCompile(`^>*From `)
+
+	archiveLocksMu sync.Mutex
+	archiveLocks   = map[string]*archiveLock{}
+)
+
+// archiveLock serializes the writes into an archive directory of all the
+// handlers sharing it, ie: the previous and new handlers of a configuration
+// reload, so that messages appended to an mbox do not interleave.
+type archiveLock struct {
+	sync.Mutex
+	seq uint64
+}
+
+func lockFor(path string) *archiveLock {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	archiveLocksMu.Lock()
+	defer archiveLocksMu.Unlock()
+
+	lock, ok := archiveLocks[path]
+	if !ok {
+		lock = &archiveLock{}
+		archiveLocks[path] = lock
+	}
+
+	return lock
+}
+
+type ArchiveHandler struct {
+	Path   string
+	Format string
+	Rotate string
+	Gzip   bool
+
+	lastMbox string
+}
+
+func (hnd *ArchiveHandler) Deliver(message string) error {
+	return hnd.DeliverMessage(NewMessage([]byte(message)))
+}
+
+func (hnd *ArchiveHandler) DeliverMessage(msg *Message) error {
+	return hnd.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext stores the message, unless ctx is done before the archive
+// could be written to.
+func (hnd *ArchiveHandler) DeliverContext(ctx context.Context, msg *Message) error {
+	lock := lockFor(hnd.Path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dir := hnd.currentDir()
+
+	if hnd.Format == ARCHIVE_FORMAT_MBOX {
+		return hnd.appendMbox(dir, msg.String())
+	}
+
+	lock.seq++
+	return hnd.writeMaildir(dir, lock.seq, msg.String())
+}
+
+func (hnd *ArchiveHandler) Describe() string {
+	desc := fmt.Sprintf("ArchiveHandler (path=%s, %s, rotate=%s", hnd.Path, hnd.Format, hnd.Rotate)
+	if hnd.Format == ARCHIVE_FORMAT_MBOX && hnd.Gzip {
+		desc += ", gzip"
+	}
+
+	return desc + ")"
+}
+
+// Check makes sure the archive directory exists and is writable.
+func (hnd *ArchiveHandler) Check(ctx context.Context) error {
+	if err := os.MkdirAll(hnd.Path, 0700); err != nil {
+		return fmt.Errorf("Could not create archive directory: %s", err)
+	}
+
+	f, err := ioutil.TempFile(hnd.Path, ".postman-check")
+	if err != nil {
+		return fmt.Errorf("Archive directory is not writable: %s", err)
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+func (hnd *ArchiveHandler) currentDir() string {
+	layout := ARCHIVE_ROTATIONS[hnd.Rotate]
+	if layout == "" {
+		return hnd.Path
+	}
+
+	return filepath.Join(hnd.Path, time.Now().Format(layout))
+}
+
+// writeMaildir stores the message as a new file in tmp/ and atomically moves
+// it into new/ once fully written, as described in
+// http://cr.yp.to/proto/maildir.html
+func (hnd *ArchiveHandler) writeMaildir(dir string, seq uint64, message string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return fmt.Errorf("Could not create maildir: %s", err)
+		}
+	}
+
+	name := maildirName(seq)
+	tmp := filepath.Join(dir, "tmp", name)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not create maildir file: %s", err)
+	}
+
+	_, err = io.WriteString(f, message)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("An error occurred while writing maildir file: %s", err)
+	}
+
+	if err = os.Rename(tmp, filepath.Join(dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Could not move message into maildir: %s", err)
+	}
+
+	return nil
+}
+
+// appendMbox appends the message to the current mbox file using the mboxrd
+// convention, rotating (and optionally compressing) the previous file when
+// the date based directory changes. A failed compression is only logged, the
+// uncompressed file is kept and the message is still archived.
+func (hnd *ArchiveHandler) appendMbox(dir string, message string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Could not create archive directory: %s", err)
+	}
+
+	file := filepath.Join(dir, archiveMboxName)
+	if hnd.Gzip {
+		if hnd.lastMbox == "" {
+			hnd.compressRotated(file)
+		} else if hnd.lastMbox != file {
+			if err := gzipFile(hnd.lastMbox); err != nil {
+				slog.Warn("could not compress rotated mbox", "file", hnd.lastMbox, "error", err)
+			}
+		}
+	}
+	hnd.lastMbox = file
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not open mbox file: %s", err)
+	}
+
+	w := bufio.NewWriter(f)
+	writeMboxMessage(w, message)
+
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("An error occurred while appending to mbox file: %s", err)
+	}
+
+	return nil
+}
+
+// compressRotated compresses the mbox files of previous periods left
+// uncompressed by an earlier run, all but current.
+func (hnd *ArchiveHandler) compressRotated(current string) {
+	if ARCHIVE_ROTATIONS[hnd.Rotate] == "" {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(hnd.Path, "*", archiveMboxName))
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if file == current {
+			continue
+		}
+		if err := gzipFile(file); err != nil {
+			slog.Warn("could not compress rotated mbox", "file", file, "error", err)
+		}
+	}
+}
+
+func writeMboxMessage(w *bufio.Writer, message string) {
+	sender := "MAILER-DAEMON"
+	date := time.Now()
+
+	if msg, err := mail.ReadMessage(bytes.NewBufferString(message)); err == nil {
+		if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			sender = addr.Address
+		}
+		if d, err := msg.Header.Date(); err == nil {
+			date = d
+		}
+	}
+
+	fmt.Fprintf(w, "From %s %s\n", sender, date.UTC().Format(time.ANSIC))
+
+	lines := strings.Split(strings.Replace(message, "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		if i == len(lines)-1 && line == "" {
+			break
+		}
+		if mboxFromLine.MatchString(line) {
+			w.WriteString(">")
+		}
+		w.WriteString(line)
+		w.WriteString("\n")
+	}
+	w.WriteString("\n")
+}
+
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	gz.Name = filepath.Base(name)
+
+	_, err = io.Copy(gz, in)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+func maildirName(seq uint64) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.Replace(strings.Replace(host, "/", `\057`, -1), ":", `\072`, -1)
+
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), seq, host)
+}
+
+func NewArchiveHandler(path string, format string, rotate string, gz bool) *ArchiveHandler {
+	return &ArchiveHandler{
+		Path:   path,
+		Format: format,
+		Rotate: rotate,
+		Gzip:   gz}
+}
+
+func ArchiveFormatValid(format string) bool {
+	return ARCHIVE_FORMATS[format]
+}
+
+func ArchiveRotationValid(rotate string) bool {
+	_, ok := ARCHIVE_ROTATIONS[rotate]
+	return ok
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mboxSeparator matches the "From " line starting each message of an mbox.
+var mboxSeparator = regexp.MustCompile(`^From \S+ \w{3} \w{3} [ \d]\d \d\d:\d\d:\d\d \d{4}$`)
+
+// readMbox splits an mboxrd file into its messages, undoing the quoting of
+// their "From " lines.
+func readMbox(t *testing.T, file string) []string {
+	t.Helper()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("could not read mbox: %s", err)
+	}
+
+	messages := []string{}
+	var current []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if mboxSeparator.MatchString(line) {
+			if current != nil {
+				messages = append(messages, strings.Join(current[:len(current)-1], "\n")+"\n")
+			}
+			current = []string{}
+			continue
+		}
+		if current == nil {
+			t.Fatalf("mbox does not start with a From line: %q", line)
+		}
+		if strings.HasPrefix(line, ">") && mboxFromLine.MatchString(line) {
+			line = line[1:]
+		}
+		current = append(current, line)
+	}
+	if current != nil {
+		messages = append(messages, strings.Join(current[:len(current)-1], "\n")+"\n")
+	}
+
+	return messages
+}
+
+func TestArchiveHandlerMbox(t *testing.T) {
+	quoted := strings.Replace(testMessage, "It is still burning.\r\n",
+		"From the start,\r\n>From the top\r\n>>From the top again\r\nFromage is not a From line.\r\n", 1)
+
+	dir := t.TempDir()
+	hnd := NewArchiveHandler(dir, ARCHIVE_FORMAT_MBOX, ARCHIVE_ROTATE_NONE, false)
+	for _, message := range []string{testMessage, quoted} {
+		if err := hnd.Deliver(message); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+
+	file := filepath.Join(dir, archiveMboxName)
+	data, _ := os.ReadFile(file)
+	if !strings.HasPrefix(string(data), "From alice@example.com Mon Jan  2 22:04:05 2006\n") {
+		t.Errorf("mbox does not start with the sender and date of the message:\n%s", data)
+	}
+	for _, want := range []string{"\n>From the start,\n", "\n>>From the top\n", "\n>>>From the top again\n", "\nFromage is not a From line.\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("mbox does not contain %q:\n%s", want, data)
+		}
+	}
+
+	messages := readMbox(t, file)
+	if len(messages) != 2 {
+		t.Fatalf("mbox holds %d messages, want 2", len(messages))
+	}
+	for i, want := range []string{testMessage, quoted} {
+		if want = strings.ReplaceAll(want, "\r\n", "\n"); messages[i] != want {
+			t.Errorf("message %d = %q, want %q", i, messages[i], want)
+		}
+	}
+}
+
+// TestArchiveHandlerMboxShared checks that handlers archiving into the same
+// mbox, as happens during a configuration reload, do not interleave messages.
+func TestArchiveHandlerMboxShared(t *testing.T) {
+	dir := t.TempDir()
+	handlers := []*ArchiveHandler{
+		NewArchiveHandler(dir, ARCHIVE_FORMAT_MBOX, ARCHIVE_ROTATE_NONE, false),
+		NewArchiveHandler(dir+"/.", ARCHIVE_FORMAT_MBOX, ARCHIVE_ROTATE_NONE, false),
+	}
+
+	// large enough for bufio to flush every message in several writes
+	body := strings.Repeat("It is still burning.\r\n", 1000)
+	message := strings.Replace(testMessage, "It is still burning.\r\n", body, 1)
+
+	var wg sync.WaitGroup
+	for _, hnd := range handlers {
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(hnd *ArchiveHandler) {
+				defer wg.Done()
+				if err := hnd.Deliver(message); err != nil {
+					t.Errorf("Deliver() error = %v", err)
+				}
+			}(hnd)
+		}
+	}
+	wg.Wait()
+
+	messages := readMbox(t, filepath.Join(dir, archiveMboxName))
+	if len(messages) != 200 {
+		t.Fatalf("mbox holds %d messages, want 200", len(messages))
+	}
+	for i, got := range messages {
+		if got != strings.ReplaceAll(message, "\r\n", "\n") {
+			t.Fatalf("message %d is corrupted", i)
+		}
+	}
+}
+
+func TestArchiveHandlerMaildir(t *testing.T) {
+	dir := t.TempDir()
+	hnd := NewArchiveHandler(dir, ARCHIVE_FORMAT_MAILDIR, ARCHIVE_ROTATE_DAILY, false)
+
+	for i := 0; i < 3; i++ {
+		if err := hnd.Deliver(testMessage); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+
+	maildir := filepath.Join(dir, time.Now().Format("2006-01-02"))
+	for _, sub := range []string{"tmp", "cur"} {
+		if entries, err := os.ReadDir(filepath.Join(maildir, sub)); err != nil || len(entries) != 0 {
+			t.Errorf("%s/ holds %d files (%v), want none", sub, len(entries), err)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(maildir, "new"))
+	if err != nil {
+		t.Fatalf("could not read new/: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("new/ holds %d files, want 3", len(entries))
+	}
+	for _, entry := range entries {
+		data, _ := os.ReadFile(filepath.Join(maildir, "new", entry.Name()))
+		if string(data) != testMessage {
+			t.Errorf("%s = %q, want the raw message", entry.Name(), data)
+		}
+	}
+}
+
+// TestArchiveHandlerGzip checks that mboxes of previous periods are
+// compressed, including those left uncompressed by an earlier run.
+func TestArchiveHandlerGzip(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, "2006-01", archiveMboxName)
+	if err := os.MkdirAll(filepath.Dir(leftover), 0700); err != nil {
+		t.Fatalf("could not create directory: %s", err)
+	}
+	if err := os.WriteFile(leftover, []byte("From alice@example.com Mon Jan  2 22:04:05 2006\n"), 0600); err != nil {
+		t.Fatalf("could not write mbox: %s", err)
+	}
+
+	hnd := NewArchiveHandler(dir, ARCHIVE_FORMAT_MBOX, ARCHIVE_ROTATE_MONTHLY, true)
+	if err := hnd.DeliverContext(context.Background(), NewMessage([]byte(testMessage))); err != nil {
+		t.Fatalf("DeliverContext() error = %v", err)
+	}
+
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("rotated mbox %s was not removed: %v", leftover, err)
+	}
+	f, err := os.Open(leftover + ".gz")
+	if err != nil {
+		t.Fatalf("rotated mbox was not compressed: %s", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("invalid gzip file: %s", err)
+	}
+	if data, _ := io.ReadAll(gz); !strings.HasPrefix(string(data), "From alice@example.com") {
+		t.Errorf("compressed mbox = %q", data)
+	}
+
+	current := filepath.Join(dir, time.Now().Format("2006-01"), archiveMboxName)
+	if _, err := os.Stat(current); err != nil {
+		t.Errorf("current mbox %s: %s", current, err)
+	}
+}
+
+func TestArchiveHandlerCancelled(t *testing.T) {
+	dir := t.TempDir()
+	hnd := NewArchiveHandler(dir, ARCHIVE_FORMAT_MBOX, ARCHIVE_ROTATE_NONE, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := hnd.DeliverContext(ctx, NewMessage([]byte(testMessage))); err != context.Canceled {
+		t.Fatalf("DeliverContext() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(filepath.Join(dir, archiveMboxName)); !os.IsNotExist(err) {
+		t.Errorf("cancelled delivery was archived: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/etrepat/postman/redact"
+)
+
+// Checker is implemented by handlers able to tell whether their delivery
+// target can be reached, without delivering anything.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Check checks the target of hnd, looking through the adapters of this
+// package. Handlers which do not implement Checker are always reachable.
+func Check(ctx context.Context, hnd interface{}) error {
+	switch h := hnd.(type) {
+	case Checker:
+		return h.Check(ctx)
+	case *messageHandlerAdapter:
+		return Check(ctx, h.MessageHandler)
+	case *contextHandlerAdapter:
+		return Check(ctx, h.Handler)
+	case *limitedHandler:
+		return Check(ctx, h.ContextHandler)
+	}
+
+	return nil
+}
+
+// dialCheck opens and closes a tcp connection to addr.
+func dialCheck(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// urlAddr returns the host:port of an http(s) url.
+func urlAddr(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("no host in url %s", redact.URL(rawurl))
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// dialURLCheck opens and closes a tcp connection to the host of an http(s)
+// url.
+func dialURLCheck(ctx context.Context, rawurl string) error {
+	addr, err := urlAddr(rawurl)
+	if err != nil {
+		return err
+	}
+
+	return dialCheck(ctx, addr)
+}
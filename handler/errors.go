@@ -0,0 +1,44 @@
+package handler
+
+// TemporaryError marks a delivery failure which is worth retrying later, ie: a
+// target being temporarily unavailable. Any other error is considered
+// permanent.
+type TemporaryError struct {
+	Err error
+}
+
+func (e *TemporaryError) Error() string {
+	return e.Err.Error()
+}
+
+// Temporary wraps err into a TemporaryError.
+func Temporary(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &TemporaryError{Err: err}
+}
+
+// IsTemporary reports whether err is a temporary delivery failure.
+func IsTemporary(err error) bool {
+	_, ok := err.(*TemporaryError)
+	return ok
+}
+
+// AbandonedError is returned when waiting for a delivery which can not be
+// cancelled was given up on. The delivery may still succeed in the
+// background, so it must not be retried.
+type AbandonedError struct {
+	Err error
+}
+
+func (e *AbandonedError) Error() string {
+	return "gave up waiting for delivery: " + e.Err.Error()
+}
+
+// IsAbandoned reports whether err is an abandoned delivery.
+func IsAbandoned(err error) bool {
+	_, ok := err.(*AbandonedError)
+	return ok
+}
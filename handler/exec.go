@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// EX_TEMPFAIL is the sysexits.h exit code a command returns to signal a
+	// temporary failure, as understood by sendmail, procmail and fetchmail.
+	EX_TEMPFAIL = 75
+
+	// EXEC_OUTPUT_MAX is the size of the command output kept for logging.
+	EXEC_OUTPUT_MAX = 64 * 1024
+
+	// EXEC_WAIT_DELAY is the time given to a killed command to release its
+	// output before giving up on it.
+	EXEC_WAIT_DELAY = 5 * time.Second
+)
+
+var envUnsafe = regexp.MustCompile(`[^A-Z0-9_]`)
+
+type ExecHandler struct {
+	Command     string
+	Mailbox     string
+	Timeout     time.Duration
+	Concurrency int
+
+	slots chan struct{}
+}
+
+func (hnd *ExecHandler) Deliver(message string) error {
+	return hnd.DeliverMessage(NewMessage([]byte(message)))
+}
+
+func (hnd *ExecHandler) DeliverMessage(msg *Message) error {
+	return hnd.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext runs the command with the raw message on stdin. A zero exit
+// status means success, EX_TEMPFAIL or a timeout mean a temporary failure,
+// and any other exit status a permanent one. The command is killed when ctx
+// is done. The output of a failed command may echo the message, so it is left
+// out of the error and only logged at debug level, see the redact package.
+func (hnd *ExecHandler) DeliverContext(ctx context.Context, msg *Message) error {
+	select {
+	case hnd.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-hnd.slots }()
+
+	if hnd.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hnd.Timeout)
+		defer cancel()
+	}
+
+	// the command runs in its own process group, killed as a whole so that
+	// no child is left behind holding the output open
+	output := &cappedBuffer{max: EXEC_OUTPUT_MAX}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hnd.Command)
+	cmd.Stdin = bytes.NewReader(msg.Raw)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = append(os.Environ(), hnd.environ(msg)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = EXEC_WAIT_DELAY
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	Logger(ctx).Debug("command output", "output", output.String())
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return Temporary(fmt.Errorf("Command timed out"))
+	} else if ctx.Err() != nil {
+		return fmt.Errorf("Command cancelled: %s", ctx.Err())
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return fmt.Errorf("Could not run command: %s", err)
+	}
+
+	err = fmt.Errorf("Command exited with status %d", exitErr.ExitCode())
+	if exitErr.ExitCode() == EX_TEMPFAIL {
+		return Temporary(err)
+	}
+
+	return err
+}
+
+func (hnd *ExecHandler) Describe() string {
+	return fmt.Sprintf("ExecHandler (command=%q, timeout=%s, concurrency=%d)", hnd.Command, hnd.Timeout, hnd.Concurrency)
+}
+
+// environ exposes the message context to the command. Metadata set by previous
+// handlers of the chain is exposed as POSTMAN_META_<KEY>, ie: "s3.url" as
+// POSTMAN_META_S3_URL.
+func (hnd *ExecHandler) environ(msg *Message) []string {
+	mailbox := msg.Mailbox
+	if mailbox == "" {
+		mailbox = hnd.Mailbox
+	}
+
+	env := []string{
+		"POSTMAN_MAILBOX=" + mailbox,
+		"POSTMAN_ACCOUNT=" + msg.Account,
+		"POSTMAN_UID=" + strconv.FormatUint(uint64(msg.UID), 10),
+		"POSTMAN_TAGS=" + strings.Join(msg.Tags, ",")}
+
+	for key, value := range msg.Metadata {
+		env = append(env, "POSTMAN_META_"+envUnsafe.ReplaceAllString(strings.ToUpper(key), "_")+"="+value)
+	}
+
+	header, err := msg.Header()
+	if err != nil {
+		return env
+	}
+
+	dec := new(mime.WordDecoder)
+	for _, key := range []string{"From", "Subject", "Message-Id"} {
+		value, err := dec.DecodeHeader(header.Get(key))
+		if err != nil {
+			value = header.Get(key)
+		}
+		name := "POSTMAN_" + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+		env = append(env, name+"="+value)
+	}
+
+	return env
+}
+
+// cappedBuffer keeps the first max bytes written to it, and discards the rest.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:room])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "..."
+	}
+
+	return b.buf.String()
+}
+
+func NewExecHandler(command string, mailbox string, timeout time.Duration, concurrency int) *ExecHandler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &ExecHandler{
+		Command:     command,
+		Mailbox:     mailbox,
+		Timeout:     timeout,
+		Concurrency: concurrency,
+		slots:       make(chan struct{}, concurrency)}
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecHandlerDeliver(t *testing.T) {
+	dir := t.TempDir()
+	command := "cat > " + filepath.Join(dir, "message") + "; env > " + filepath.Join(dir, "env")
+
+	msg := NewMessage([]byte(testMessage))
+	msg.UID = 42
+	msg.Mailbox = "Tickets"
+	msg.Account = "support@example.com"
+	msg.Set("s3.url", "http://s3/mail/42.eml")
+
+	hnd := NewExecHandler(command, "INBOX", time.Minute, 1)
+	if err := hnd.DeliverContext(context.Background(), msg); err != nil {
+		t.Fatalf("DeliverContext() error = %v", err)
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(dir, "message")); string(data) != testMessage {
+		t.Errorf("stdin = %q, want the raw message", data)
+	}
+
+	env, _ := os.ReadFile(filepath.Join(dir, "env"))
+	for _, want := range []string{
+		"POSTMAN_MAILBOX=Tickets",
+		"POSTMAN_ACCOUNT=support@example.com",
+		"POSTMAN_UID=42",
+		"POSTMAN_FROM=Alice <alice@example.com>",
+		"POSTMAN_SUBJECT=Printer on fire",
+		"POSTMAN_MESSAGE_ID=<1234@example.com>",
+		"POSTMAN_META_S3_URL=http://s3/mail/42.eml",
+	} {
+		if !strings.Contains(string(env), want+"\n") {
+			t.Errorf("environment does not contain %q", want)
+		}
+	}
+}
+
+func TestExecHandlerFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		command   string
+		timeout   time.Duration
+		temporary bool
+	}{
+		{"permanent failure", "cat; exit 1", time.Minute, false},
+		{"temporary failure", "cat; exit 75", time.Minute, true},
+		{"command not found", "cat; postman-no-such-command", time.Minute, false},
+		// the background sleep holds the output open unless the whole
+		// process group is killed
+		{"timeout", "cat; sleep 30 & sleep 30", 100 * time.Millisecond, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hnd := NewExecHandler(tt.command, "INBOX", tt.timeout, 1)
+
+			start := time.Now()
+			err := hnd.DeliverContext(context.Background(), NewMessage([]byte(testMessage)))
+			if err == nil {
+				t.Fatalf("DeliverContext() succeeded")
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("DeliverContext() took %s", elapsed)
+			}
+			if IsTemporary(err) != tt.temporary {
+				t.Errorf("IsTemporary(%v) = %v, want %v", err, IsTemporary(err), tt.temporary)
+			}
+			// the command echoes the message, which must stay out of logs
+			if strings.Contains(err.Error(), "Printer on fire") {
+				t.Errorf("DeliverContext() error = %q leaks the command output", err)
+			}
+		})
+	}
+}
+
+func TestExecHandlerCancelled(t *testing.T) {
+	hnd := NewExecHandler("sleep 30", "INBOX", 0, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	err := hnd.DeliverContext(ctx, NewMessage([]byte(testMessage)))
+	if err == nil || IsTemporary(err) {
+		t.Errorf("DeliverContext() error = %v, want a permanent error", err)
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	b := &cappedBuffer{max: 8}
+	for _, s := range []string{"0123", "4567", "89"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+
+	if got := b.String(); got != "01234567..." {
+		t.Errorf("String() = %q, want %q", got, "01234567...")
+	}
+}
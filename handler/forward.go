@@ -0,0 +1,311 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/etrepat/postman/imap"
+)
+
+const (
+	FORWARD_STYLE_INLINE   = "inline"
+	FORWARD_STYLE_ATTACH   = "attach"
+	FORWARD_STYLE_REDIRECT = "redirect"
+
+	// bounds the connection to the SMTP server, deliveries being bounded by
+	// their context
+	SMTP_DIAL_TIMEOUT = 30 * time.Second
+)
+
+var FORWARD_STYLES = map[string]bool{
+	FORWARD_STYLE_INLINE:   true,
+	FORWARD_STYLE_ATTACH:   true,
+	FORWARD_STYLE_REDIRECT: true}
+
+type ForwardHandler struct {
+	Host     string
+	Port     uint
+	Username string
+	Password string
+	From     string
+	To       []string
+	Style    string
+	// one of imap.TLS_IMPLICIT, imap.TLS_STARTTLS, imap.TLS_PLAINTEXT, or
+	// implicit TLS on port 465 and required STARTTLS otherwise when empty
+	TLSMode string
+}
+
+func (hnd *ForwardHandler) Deliver(message string) error {
+	return hnd.DeliverContext(context.Background(), NewMessage([]byte(message)))
+}
+
+func (hnd *ForwardHandler) DeliverMessage(msg *Message) error {
+	return hnd.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext forwards the message, giving up as soon as ctx is done.
+func (hnd *ForwardHandler) DeliverContext(ctx context.Context, msg *Message) error {
+	message := msg.String()
+	original, err := mail.ReadMessage(bytes.NewBufferString(message))
+	if err != nil {
+		return fmt.Errorf("Could not parse message: %s", err)
+	}
+
+	var data []byte
+	switch hnd.Style {
+	case FORWARD_STYLE_REDIRECT:
+		data = hnd.redirect(message)
+	case FORWARD_STYLE_ATTACH:
+		data, err = hnd.attach(original, message)
+	default:
+		data, err = hnd.inline(original, message)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not build forwarded message: %s", err)
+	}
+
+	return hnd.send(ctx, data)
+}
+
+func (hnd *ForwardHandler) Describe() string {
+	return fmt.Sprintf("ForwardHandler (smtp=%s, %s, to=%s, %s)", hnd.Addr(), hnd.tlsMode(), strings.Join(hnd.To, ","), hnd.Style)
+}
+
+// Check connects to the SMTP server.
+func (hnd *ForwardHandler) Check(ctx context.Context) error {
+	return dialCheck(ctx, hnd.Addr())
+}
+
+func (hnd *ForwardHandler) Addr() string {
+	return fmt.Sprintf("%s:%d", hnd.Host, hnd.Port)
+}
+
+// tlsMode returns TLSMode, or else implicit TLS on port 465 and required
+// STARTTLS otherwise.
+func (hnd *ForwardHandler) tlsMode() string {
+	if hnd.TLSMode != "" {
+		return hnd.TLSMode
+	}
+	if hnd.Port == 465 {
+		return imap.TLS_IMPLICIT
+	}
+
+	return imap.TLS_STARTTLS
+}
+
+// redirect keeps the original message untouched and prepends Resent-* headers,
+// as described in RFC 5322 section 3.6.6.
+func (hnd *ForwardHandler) redirect(raw string) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Resent-From: %s\r\n", hnd.From)
+	fmt.Fprintf(&buf, "Resent-To: %s\r\n", strings.Join(hnd.To, ", "))
+	fmt.Fprintf(&buf, "Resent-Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Resent-Message-ID: %s\r\n", newMessageId())
+	buf.WriteString(raw)
+
+	return buf.Bytes()
+}
+
+// inline forwards the message body as plain text below a quoted header block.
+func (hnd *ForwardHandler) inline(original *mail.Message, raw string) ([]byte, error) {
+	n, err := Render(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	hnd.writeHeaders(&buf, original)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString("---------- Forwarded message ----------\r\n")
+	for _, key := range []string{"From", "Date", "Subject", "To", "Cc"} {
+		if value := original.Header.Get(key); value != "" {
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(n.Text)
+
+	return buf.Bytes(), nil
+}
+
+// attach wraps the whole original message as a message/rfc822 part.
+func (hnd *ForwardHandler) attach(original *mail.Message, raw string) ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "Forwarded message from %s attached.\r\n", original.Header.Get("From"))
+
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/rfc822"},
+		"Content-Disposition": {"attachment; filename=\"forwarded.eml\""}})
+	if err != nil {
+		return nil, err
+	}
+	part.Write([]byte(raw))
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	hnd.writeHeaders(&buf, original)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n", writer.Boundary())
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+func (hnd *ForwardHandler) writeHeaders(buf *bytes.Buffer, original *mail.Message) {
+	fmt.Fprintf(buf, "From: %s\r\n", hnd.From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(hnd.To, ", "))
+	fmt.Fprintf(buf, "Subject: Fwd: %s\r\n", original.Header.Get("Subject"))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: %s\r\n", newMessageId())
+	if id := original.Header.Get("Message-Id"); id != "" {
+		fmt.Fprintf(buf, "References: %s\r\n", id)
+	}
+}
+
+// send relays data to the recipients. Credentials and messages only go out
+// encrypted, but in plaintext mode to the local host.
+func (hnd *ForwardHandler) send(ctx context.Context, data []byte) error {
+	mode := hnd.tlsMode()
+	if mode == imap.TLS_PLAINTEXT && !imap.IsLocalhost(hnd.Host) {
+		return fmt.Errorf("Plaintext SMTP connections are only allowed to localhost, not %s.", hnd.Host)
+	}
+
+	dialer := &net.Dialer{Timeout: SMTP_DIAL_TIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", hnd.Addr())
+	if err != nil {
+		return smtpError("SMTP dial error", err)
+	}
+
+	// the whole exchange is bounded by ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	config := &tls.Config{ServerName: hnd.Host}
+	if mode == imap.TLS_IMPLICIT {
+		conn = tls.Client(conn, config)
+	}
+
+	c, err := smtp.NewClient(conn, hnd.Host)
+	if err != nil {
+		conn.Close()
+		return smtpError("SMTP dial error", err)
+	}
+	defer c.Close()
+
+	if mode == imap.TLS_STARTTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server %s does not support STARTTLS", hnd.Addr())
+		}
+		if err = c.StartTLS(config); err != nil {
+			return smtpError("Could not establish TLS encrypted SMTP connection", err)
+		}
+	}
+
+	if hnd.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("SMTP server %s does not support authentication", hnd.Addr())
+		}
+		if err = c.Auth(smtp.PlainAuth("", hnd.Username, hnd.Password, hnd.Host)); err != nil {
+			return smtpError("SMTP authentication failed", err)
+		}
+	}
+
+	if err = c.Mail(hnd.From); err != nil {
+		return smtpError("SMTP server rejected sender "+hnd.From, err)
+	}
+	for _, rcpt := range hnd.To {
+		if err = c.Rcpt(rcpt); err != nil {
+			return smtpError("SMTP server rejected recipient "+rcpt, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return smtpError("SMTP DATA command failed", err)
+	}
+	if _, err = w.Write(data); err != nil {
+		return smtpError("An error occurred while sending message data", err)
+	}
+	if err = w.Close(); err != nil {
+		return smtpError("SMTP server refused message", err)
+	}
+
+	return c.Quit()
+}
+
+// smtpError prefixes err with message. Transient failures, that is 4xx replies
+// (ie: greylisting) and network errors, are marked temporary so the delivery is
+// retried, while 5xx replies are permanent.
+func smtpError(message string, err error) error {
+	failure := fmt.Errorf("%s: %s", message, err)
+
+	var reply *textproto.Error
+	var netErr net.Error
+	if errors.As(err, &reply) {
+		if reply.Code/100 == 4 {
+			return Temporary(failure)
+		}
+	} else if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return Temporary(failure)
+	}
+
+	return failure
+}
+
+func NewForwardHandler(host string, port uint, username string, password string, from string, to []string, style string, tlsMode string) *ForwardHandler {
+	return &ForwardHandler{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		From:     from,
+		To:       to,
+		Style:    style,
+		TLSMode:  tlsMode}
+}
+
+func ForwardStyleValid(style string) bool {
+	return FORWARD_STYLES[style]
+}
+
+func newMessageId() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+
+	return fmt.Sprintf("<%x.%d@%s>", b, time.Now().UnixNano(), host)
+}
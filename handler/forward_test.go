@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/etrepat/postman/imap"
+)
+
+// fakeSMTP is an SMTP server keeping the messages it is sent, and answering
+// RCPT commands with rcptReply.
+type fakeSMTP struct {
+	listener  net.Listener
+	rcptReply string
+	messages  chan string
+}
+
+func newFakeSMTP(t *testing.T, rcptReply string) *fakeSMTP {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &fakeSMTP{listener: l, rcptReply: rcptReply, messages: make(chan string, 1)}
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(textproto.NewConn(conn))
+	}
+}
+
+func (s *fakeSMTP) handle(c *textproto.Conn) {
+	defer c.Close()
+
+	c.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, _, _ := strings.Cut(strings.ToUpper(line), " ")
+		switch verb {
+		case "EHLO", "HELO", "MAIL":
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			c.PrintfLine("%s", s.rcptReply)
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.messages <- string(data)
+			c.PrintfLine("250 Queued")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) handler(t *testing.T, style string, tlsMode string) *ForwardHandler {
+	t.Helper()
+
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	p, _ := strconv.ParseUint(port, 10, 16)
+
+	return NewForwardHandler(host, uint(p), "", "", "postman@example.com", []string{"helpdesk@example.com"}, style, tlsMode)
+}
+
+func TestForwardHandlerDeliver(t *testing.T) {
+	tests := []struct {
+		style string
+		want  []string
+	}{
+		{
+			style: FORWARD_STYLE_INLINE,
+			want: []string{
+				"From: postman@example.com\n",
+				"To: helpdesk@example.com\n",
+				"Subject: Fwd: Printer on fire\n",
+				"References: <1234@example.com>\n",
+				"---------- Forwarded message ----------\nFrom: Alice <alice@example.com>\n",
+				"It is still burning.",
+			},
+		},
+		{
+			style: FORWARD_STYLE_ATTACH,
+			want: []string{
+				"Subject: Fwd: Printer on fire\n",
+				"Content-Type: multipart/mixed; boundary=",
+				"Forwarded message from Alice <alice@example.com> attached.",
+				"Content-Type: message/rfc822\n",
+				"Subject: Printer on fire\n",
+			},
+		},
+		{
+			style: FORWARD_STYLE_REDIRECT,
+			want: []string{
+				"Resent-From: postman@example.com\n",
+				"Resent-To: helpdesk@example.com\n",
+				"Resent-Message-ID: <",
+				strings.ReplaceAll(testMessage, "\r\n", "\n"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.style, func(t *testing.T) {
+			s := newFakeSMTP(t, "250 OK")
+			hnd := s.handler(t, tt.style, imap.TLS_PLAINTEXT)
+
+			if err := hnd.Deliver(testMessage); err != nil {
+				t.Fatalf("Deliver() error = %v", err)
+			}
+
+			message := <-s.messages
+			for _, want := range tt.want {
+				if !strings.Contains(message, want) {
+					t.Errorf("forwarded message does not contain %q:\n%s", want, message)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardHandlerFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		rcptReply string
+		host      string
+		tlsMode   string
+		temporary bool
+	}{
+		{
+			name:      "greylisted",
+			rcptReply: "450 4.2.0 Greylisted, try again later",
+			tlsMode:   imap.TLS_PLAINTEXT,
+			temporary: true,
+		},
+		{
+			name:      "unknown recipient",
+			rcptReply: "550 5.1.1 No such user",
+			tlsMode:   imap.TLS_PLAINTEXT,
+			temporary: false,
+		},
+		{
+			name:      "unreachable server",
+			host:      "closed",
+			tlsMode:   imap.TLS_PLAINTEXT,
+			temporary: true,
+		},
+		{
+			name:      "plaintext to a remote server",
+			host:      "smtp.example.com",
+			tlsMode:   imap.TLS_PLAINTEXT,
+			temporary: false,
+		},
+		{
+			name:      "no STARTTLS support",
+			rcptReply: "250 OK",
+			tlsMode:   imap.TLS_STARTTLS,
+			temporary: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeSMTP(t, tt.rcptReply)
+			hnd := s.handler(t, FORWARD_STYLE_REDIRECT, tt.tlsMode)
+			switch tt.host {
+			case "closed":
+				host, port, _ := net.SplitHostPort(closedAddr(t))
+				p, _ := strconv.ParseUint(port, 10, 16)
+				hnd.Host, hnd.Port = host, uint(p)
+			case "":
+			default:
+				hnd.Host = tt.host
+			}
+
+			err := hnd.DeliverContext(context.Background(), NewMessage([]byte(testMessage)))
+			if err == nil {
+				t.Fatalf("DeliverContext() succeeded")
+			}
+			if IsTemporary(err) != tt.temporary {
+				t.Errorf("IsTemporary(%v) = %v, want %v", err, IsTemporary(err), tt.temporary)
+			}
+		})
+	}
+}
+
+func TestForwardHandlerTLSMode(t *testing.T) {
+	tests := []struct {
+		port    uint
+		tlsMode string
+		want    string
+	}{
+		{465, "", imap.TLS_IMPLICIT},
+		{587, "", imap.TLS_STARTTLS},
+		{25, "", imap.TLS_STARTTLS},
+		{25, imap.TLS_PLAINTEXT, imap.TLS_PLAINTEXT},
+		{465, imap.TLS_STARTTLS, imap.TLS_STARTTLS},
+	}
+
+	for _, tt := range tests {
+		hnd := NewForwardHandler("smtp.example.com", tt.port, "", "", "", nil, FORWARD_STYLE_INLINE, tt.tlsMode)
+		if got := hnd.tlsMode(); got != tt.want {
+			t.Errorf("tlsMode() on port %d with %q = %q, want %q", tt.port, tt.tlsMode, got, tt.want)
+		}
+	}
+}
@@ -1,12 +1,25 @@
 package handler
 
-import "log"
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
 
 const (
 	POSTBACK_HANDLER = 1 << iota
 	LOGGER_HANDLER
 	SMART_HANDLER
 	HIPCHAT_HANDLER
+	FORWARD_HANDLER
+	ARCHIVE_HANDLER
+	EXEC_HANDLER
+	AMQP_HANDLER
+	NATS_HANDLER
+	KAFKA_HANDLER
+	S3_HANDLER
 )
 
 type MessageHandler interface {
@@ -14,20 +27,159 @@ type MessageHandler interface {
 	Describe() string
 }
 
-func New(t uint, args ...interface{}) (hnd MessageHandler) {
+// Handler is implemented by handlers working on a Message rather than on the
+// raw message string. Handlers are chained, each one receiving the Message
+// as left by the previous one.
+type Handler interface {
+	DeliverMessage(msg *Message) error
+	Describe() string
+}
+
+// ContextHandler is implemented by handlers which can be cancelled. The
+// context carries shutdown, per-handler timeout and per-message deadline.
+type ContextHandler interface {
+	Handler
+	DeliverContext(ctx context.Context, msg *Message) error
+}
+
+type messageHandlerAdapter struct {
+	MessageHandler
+}
+
+func (a *messageHandlerAdapter) DeliverMessage(msg *Message) error {
+	return a.Deliver(msg.String())
+}
+
+// Adapt turns a MessageHandler into a Handler, so that handlers only
+// implementing Deliver(string) can be part of a chain.
+func Adapt(hnd MessageHandler) Handler {
+	if h, ok := hnd.(Handler); ok {
+		return h
+	}
+
+	return &messageHandlerAdapter{hnd}
+}
+
+type contextHandlerAdapter struct {
+	Handler
+}
+
+// DeliverContext runs the delivery in the background and gives up waiting for
+// it as soon as ctx is done. The delivery itself can not be cancelled, so an
+// AbandonedError is returned rather than ctx.Err().
+func (a *contextHandlerAdapter) DeliverContext(ctx context.Context, msg *Message) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- a.DeliverMessage(msg)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return &AbandonedError{Err: ctx.Err()}
+	}
+}
+
+// AdaptContext turns a Handler into a ContextHandler.
+func AdaptContext(hnd Handler) ContextHandler {
+	if h, ok := hnd.(ContextHandler); ok {
+		return h
+	}
+
+	return &contextHandlerAdapter{hnd}
+}
+
+type limitedHandler struct {
+	ContextHandler
+	slots chan struct{}
+}
+
+func (l *limitedHandler) DeliverMessage(msg *Message) error {
+	return l.DeliverContext(context.Background(), msg)
+}
+
+func (l *limitedHandler) DeliverContext(ctx context.Context, msg *Message) error {
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-l.slots }()
+
+	return l.ContextHandler.DeliverContext(ctx, msg)
+}
+
+// Limit restricts hnd to n concurrent deliveries, others wait for a free slot.
+func Limit(hnd ContextHandler, n int) ContextHandler {
+	if n < 1 {
+		return hnd
+	}
+
+	return &limitedHandler{
+		ContextHandler: hnd,
+		slots:          make(chan struct{}, n)}
+}
+
+// Close releases the resources held by hnd, ie: broker connections, looking
+// through the adapters of this package. Handlers which do not implement
+// io.Closer hold none.
+func Close(hnd interface{}) error {
+	switch h := hnd.(type) {
+	case io.Closer:
+		return h.Close()
+	case *messageHandlerAdapter:
+		return Close(h.MessageHandler)
+	case *contextHandlerAdapter:
+		return Close(h.Handler)
+	case *limitedHandler:
+		return Close(h.ContextHandler)
+	}
+
+	return nil
+}
+
+// New returns the handler of type t, built from the positional args of its
+// constructor. It fails when args are invalid, ie: a malformed endpoint.
+func New(t uint, args ...interface{}) (hnd MessageHandler, err error) {
 	switch t {
 	case POSTBACK_HANDLER:
 		hnd = NewPostBackHandler(args[0].(string), args[1].(bool), args[2].(string))
 
 	case LOGGER_HANDLER:
-		hnd = NewLoggerHandler(args[0].(*log.Logger))
+		var logger *slog.Logger
+		if len(args) > 0 {
+			logger = args[0].(*slog.Logger)
+		}
+		hnd = NewLoggerHandler(logger)
 
 	case SMART_HANDLER:
 		hnd = NewSmartHandler()
 
 	case HIPCHAT_HANDLER:
-		hnd = NewHipChatHandler(args[0].(string), args[1].(string), args[2].(string))
+		hnd = NewHipChatHandler(args[0].(string), args[1].(string), args[2].(string), args[3].(string))
+
+	case FORWARD_HANDLER:
+		hnd = NewForwardHandler(args[0].(string), args[1].(uint), args[2].(string), args[3].(string), args[4].(string), args[5].([]string), args[6].(string), args[7].(string))
+
+	case ARCHIVE_HANDLER:
+		hnd = NewArchiveHandler(args[0].(string), args[1].(string), args[2].(string), args[3].(bool))
+
+	case EXEC_HANDLER:
+		hnd = NewExecHandler(args[0].(string), args[1].(string), args[2].(time.Duration), args[3].(int))
+
+	case AMQP_HANDLER:
+		hnd = NewAmqpHandler(args[0].(string), args[1].(string), args[2].(string), args[3].(string))
+
+	case NATS_HANDLER:
+		hnd = NewNatsHandler(args[0].(string), args[1].(string), args[2].(string), args[3].(string))
+
+	case KAFKA_HANDLER:
+		hnd = NewKafkaHandler(strings.Split(args[0].(string), ","), args[1].(string), args[2].(string), args[3].(string))
+
+	case S3_HANDLER:
+		hnd, err = NewS3Handler(args[0].(string), args[1].(bool), args[2].(string), args[3].(string), args[4].(string), args[5].(string), args[6].(string), args[7].(string))
 	}
 
-	return hnd
+	return hnd, err
 }
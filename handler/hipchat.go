@@ -2,154 +2,122 @@ package handler
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
-	"net/mail"
-	"strings"
-
-	"github.com/jaytaylor/html2text"
-	"github.com/kennygrant/sanitize"
-	"github.com/tbruyelle/hipchat-go/hipchat"
-	"github.com/vjeantet/go.enmime"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 )
 
-var (
-	allowedTags = []string{"a", "b", "i", "strong", "em", "br", "img", "pre", "code", "li", "table", "ol", "thead", "tr", "th", "tbody", "td"}
+const (
+	//HipChatAPIURL is the HipChat v2 REST API endpoint
+	HipChatAPIURL = "https://api.hipchat.com/v2/"
 
-	allowedAttributes = []string{"id", "class", "src", "href", "title", "alt", "name", "rel"}
+	//HIPCHAT_FORMAT_TEXT and HIPCHAT_FORMAT_HTML are the notification formats
+	HIPCHAT_FORMAT_TEXT = "text"
+	HIPCHAT_FORMAT_HTML = "html"
+
+	//hipChatMaxLength is the maximum message length supported by hipchat api
+	hipChatMaxLength = 10000
 )
 
-//HipChatHandler struct
-type HipChatHandler struct {
+//HipChatNotifier sends notifications to a HipChat room
+type HipChatNotifier struct {
 	RoomAuth  string
 	RoomName  string
 	RoomColor string
+	//Format is HIPCHAT_FORMAT_TEXT unless set to HIPCHAT_FORMAT_HTML
+	Format  string
+	BaseURL string
 }
 
-//Deliver handles hipchat delivery
-func (hnd *HipChatHandler) Deliver(message string) error {
-	mailMessage, _ := mail.ReadMessage(bytes.NewBufferString(message))
-	mime, _ := enmime.ParseMIMEBody(mailMessage)
-
-	return sendHipChat(mime, hnd)
-}
-
-//short truncate message, note not unicode compliant
-func short(s string, i int) string {
-	runes := []rune(s)
-	if len(runes) > i {
-		return string(runes[:i])
-	}
-	return s
+type hipChatNotificationRequest struct {
+	Color         string `json:"color,omitempty"`
+	Message       string `json:"message"`
+	MessageFormat string `json:"message_format,omitempty"`
 }
 
-//sendHipChat transform email to message, log and send to hipchat room
-func sendHipChat(mime *enmime.MIMEBody, hnd *HipChatHandler) error {
-
-	s := `
-De    : %s
-Sujet : %s
-Text  : %d chars
-Html  : %d chars
-Inlines      : %d
-Attachements : %d
-Others       : %d`
-
-	message := fmt.Sprintf(s,
-		mime.GetHeader("From"),
-		mime.GetHeader("Subject"),
-		len(mime.Text),
-		len(mime.Html),
-		len(mime.Inlines),
-		len(mime.Attachments),
-		len(mime.OtherParts),
-	)
-
-	//log general message information
-	log.Println(message)
-
-	messageFormat := "text"
-
-	if strings.Contains(mime.Text, "<html>") {
-		messageFormat = "html"
-		message = sanitizeMessage(mime.Html)
-	} else {
+//Notify sends the notification to the hipchat room
+func (n *HipChatNotifier) Notify(ctx context.Context, notification *Notification) error {
+	message, messageFormat := n.render(notification)
 
-		s = `
-From     : %s
-Subject  : %s
-%s`
-
-		message = fmt.Sprintf(s,
-			mime.GetHeader("From"),
-			mime.GetHeader("Subject"),
-			mime.Text,
-		)
+	body, err := json.Marshal(&hipChatNotificationRequest{
+		Color:         n.RoomColor,
+		Message:       message,
+		MessageFormat: messageFormat})
+	if err != nil {
+		return err
 	}
 
-	//need to truncate message to 10000, supported by hipchat api
-	message = short(message, 10000)
-
-	//log what sending to hipchat
-	log.Println(message)
-
-	c := hipchat.NewClient(hnd.RoomAuth)
-
-	//If specify html, need to determine/format the escape characters
-	notifRq := &hipchat.NotificationRequest{Color: hnd.RoomColor, Message: message, MessageFormat: messageFormat}
-
-	_, err := c.Room.Notification(hnd.RoomName, notifRq)
+	endpoint := fmt.Sprintf("%sroom/%s/notification", n.BaseURL, url.PathEscape(n.RoomName))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
 	if err != nil {
-		log.Println("failed to send to hipchat: " + err.Error())
-		return err
+		return fmt.Errorf("Unable to build request object: %s", err)
 	}
 
-	return nil
-}
+	req.Header.Add("Authorization", "Bearer "+n.RoomAuth)
+	req.Header.Add("Content-Type", "application/json")
 
-//formatMessage make into text if contains html
-func formatMessage(message string) string {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Temporary(fmt.Errorf("Request into hipchat failed: %s", err))
+	}
 
-	isHTML := strings.Contains(message, "<html>")
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 
-	if isHTML {
-		text, err := html2text.FromString(message)
-		if err != nil {
-			log.Println("failed to convert to text " + err.Error())
-		}
-		return text
+	if !responseOk(resp.StatusCode) {
+		return responseError(resp.StatusCode, fmt.Errorf("HipChat returned with error: %s\n%q", resp.Status, data))
 	}
 
-	return message
+	return nil
 }
 
-func sanitizeMessage(message string) string {
-
-	isHTML := strings.Contains(message, "<html>")
-
-	if isHTML {
-
-		text, err := sanitize.HTMLAllowing(message, allowedTags, allowedAttributes)
-
-		if err != nil {
-			log.Println("failed to convert to text " + err.Error())
-		}
-		return text
+//render returns the message of the notification and its format. Html can not
+//be truncated safely, so html too long for the hipchat api falls back to the
+//text rendering, which is truncated.
+func (n *HipChatNotifier) render(notification *Notification) (string, string) {
+	if n.Format == HIPCHAT_FORMAT_HTML && notification.Html != "" && len([]rune(notification.Html)) <= hipChatMaxLength {
+		return notification.Html, HIPCHAT_FORMAT_HTML
 	}
 
-	return message
+	message := fmt.Sprintf("From     : %s\nSubject  : %s\n%s",
+		notification.From,
+		notification.Subject,
+		notification.Text,
+	)
+
+	return short(message, hipChatMaxLength), HIPCHAT_FORMAT_TEXT
+}
 
+//Describe the notifier
+func (n *HipChatNotifier) Describe() string {
+	return fmt.Sprintf("HipChat Handler (room=%s)", n.RoomName)
 }
 
-//Describe the handler
-func (hnd *HipChatHandler) Describe() string {
-	return "HipChat Handler"
+//Check connects to the hipchat api host
+func (n *HipChatNotifier) Check(ctx context.Context) error {
+	return dialURLCheck(ctx, n.BaseURL)
 }
 
-//NewHipChatHandler create the handler
-func NewHipChatHandler(roomAuth string, roomName string, roomColor string) *HipChatHandler {
-	return &HipChatHandler{
+//NewHipChatNotifier create the notifier
+func NewHipChatNotifier(roomAuth string, roomName string, roomColor string, format string) *HipChatNotifier {
+	return &HipChatNotifier{
 		RoomAuth:  roomAuth,
 		RoomName:  roomName,
-		RoomColor: roomColor}
+		RoomColor: roomColor,
+		Format:    format,
+		BaseURL:   HipChatAPIURL}
+}
+
+//HipChatFormatValid reports whether format is a notification format, or
+//empty for the text format
+func HipChatFormatValid(format string) bool {
+	return format == "" || format == HIPCHAT_FORMAT_TEXT || format == HIPCHAT_FORMAT_HTML
+}
+
+//NewHipChatHandler create a handler delivering messages to a hipchat room
+func NewHipChatHandler(roomAuth string, roomName string, roomColor string, format string) *NotifierHandler {
+	return NewNotifierHandler(NewHipChatNotifier(roomAuth, roomName, roomColor, format))
 }
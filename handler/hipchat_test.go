@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: support@example.com\r\n" +
+	"Subject: Printer on fire\r\n" +
+	"Message-Id: <1234@example.com>\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 -0700\r\n" +
+	"\r\n" +
+	"It is still burning.\r\n"
+
+// fakeNotifier records the notifications it is handed.
+type fakeNotifier struct {
+	notifications []*Notification
+	err           error
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, notification *Notification) error {
+	n.notifications = append(n.notifications, notification)
+	return n.err
+}
+
+func (n *fakeNotifier) Describe() string {
+	return "fake"
+}
+
+func TestNotifierHandlerDeliver(t *testing.T) {
+	failure := errors.New("room is gone")
+
+	tests := []struct {
+		name    string
+		message string
+		err     error
+		from    string
+		subject string
+		text    string
+	}{
+		{
+			name:    "text message",
+			message: testMessage,
+			from:    "Alice <alice@example.com>",
+			subject: "Printer on fire",
+			text:    "It is still burning.",
+		},
+		{
+			name:    "notifier failure",
+			message: testMessage,
+			err:     failure,
+			from:    "Alice <alice@example.com>",
+			subject: "Printer on fire",
+			text:    "It is still burning.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier := &fakeNotifier{err: tt.err}
+			err := NewNotifierHandler(notifier).Deliver(tt.message)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Deliver() error = %v, want %v", err, tt.err)
+			}
+
+			if len(notifier.notifications) != 1 {
+				t.Fatalf("got %d notifications, want 1", len(notifier.notifications))
+			}
+			n := notifier.notifications[0]
+			if n.From != tt.from {
+				t.Errorf("From = %q, want %q", n.From, tt.from)
+			}
+			if n.Subject != tt.subject {
+				t.Errorf("Subject = %q, want %q", n.Subject, tt.subject)
+			}
+			if strings.TrimSpace(n.Text) != tt.text {
+				t.Errorf("Text = %q, want %q", n.Text, tt.text)
+			}
+		})
+	}
+}
+
+func TestHipChatNotify(t *testing.T) {
+	long := strings.Repeat("<b>x</b>", hipChatMaxLength)
+
+	tests := []struct {
+		name         string
+		format       string
+		notification *Notification
+		status       int
+		message      string
+		truncated    bool
+		wantFormat   string
+		wantErr      bool
+		temporary    bool
+	}{
+		{
+			name:         "text by default",
+			format:       "",
+			notification: &Notification{From: "alice@example.com", Subject: "Hello", Text: "body", Html: "<b>body</b>"},
+			status:       http.StatusNoContent,
+			message:      "From     : alice@example.com\nSubject  : Hello\nbody",
+			wantFormat:   HIPCHAT_FORMAT_TEXT,
+		},
+		{
+			name:         "html when configured",
+			format:       HIPCHAT_FORMAT_HTML,
+			notification: &Notification{From: "alice@example.com", Subject: "Hello", Text: "body", Html: "<b>body</b>"},
+			status:       http.StatusNoContent,
+			message:      "<b>body</b>",
+			wantFormat:   HIPCHAT_FORMAT_HTML,
+		},
+		{
+			name:         "text when there is no html",
+			format:       HIPCHAT_FORMAT_HTML,
+			notification: &Notification{From: "alice@example.com", Subject: "Hello", Text: "body"},
+			status:       http.StatusNoContent,
+			message:      "From     : alice@example.com\nSubject  : Hello\nbody",
+			wantFormat:   HIPCHAT_FORMAT_TEXT,
+		},
+		{
+			name:         "text when html is too long",
+			format:       HIPCHAT_FORMAT_HTML,
+			notification: &Notification{From: "alice@example.com", Subject: "Hello", Text: strings.Repeat("x", 2*hipChatMaxLength), Html: long},
+			status:       http.StatusNoContent,
+			message:      "From     : alice@example.com\nSubject  : Hello\nxxx",
+			truncated:    true,
+			wantFormat:   HIPCHAT_FORMAT_TEXT,
+		},
+		{
+			name:         "api error",
+			notification: &Notification{From: "alice@example.com", Subject: "Hello", Text: "body"},
+			status:       http.StatusUnauthorized,
+			wantErr:      true,
+		},
+		{
+			name:         "rate limited",
+			notification: &Notification{From: "alice@example.com", Subject: "Hello", Text: "body"},
+			status:       http.StatusTooManyRequests,
+			wantErr:      true,
+			temporary:    true,
+		},
+		{
+			name:         "unavailable",
+			notification: &Notification{From: "alice@example.com", Subject: "Hello", Text: "body"},
+			status:       http.StatusServiceUnavailable,
+			wantErr:      true,
+			temporary:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path, auth string
+			var req hipChatNotificationRequest
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.EscapedPath()
+				auth = r.Header.Get("Authorization")
+				json.NewDecoder(r.Body).Decode(&req)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			notifier := NewHipChatNotifier("secret", "Help Desk", "red", tt.format)
+			notifier.BaseURL = srv.URL + "/"
+
+			err := notifier.Notify(context.Background(), tt.notification)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Notify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if IsTemporary(err) != tt.temporary {
+					t.Errorf("IsTemporary(%v) = %v, want %v", err, IsTemporary(err), tt.temporary)
+				}
+				return
+			}
+
+			if path != "/room/Help%20Desk/notification" {
+				t.Errorf("path = %q", path)
+			}
+			if auth != "Bearer secret" {
+				t.Errorf("Authorization = %q", auth)
+			}
+			if req.Color != "red" {
+				t.Errorf("color = %q, want red", req.Color)
+			}
+			if req.MessageFormat != tt.wantFormat {
+				t.Errorf("message_format = %q, want %q", req.MessageFormat, tt.wantFormat)
+			}
+			if tt.truncated {
+				if !strings.HasPrefix(req.Message, tt.message) || len([]rune(req.Message)) > hipChatMaxLength {
+					t.Errorf("message of %d chars not truncated to %d", len([]rune(req.Message)), hipChatMaxLength)
+				}
+			} else if req.Message != tt.message {
+				t.Errorf("message = %q, want %q", req.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestHipChatFormatValid(t *testing.T) {
+	tests := []struct {
+		format string
+		want   bool
+	}{
+		{"", true},
+		{HIPCHAT_FORMAT_TEXT, true},
+		{HIPCHAT_FORMAT_HTML, true},
+		{"markdown", false},
+	}
+
+	for _, tt := range tests {
+		if got := HipChatFormatValid(tt.format); got != tt.want {
+			t.Errorf("HipChatFormatValid(%q) = %v, want %v", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestHipChatHandlerDeliver(t *testing.T) {
+	var req hipChatNotificationRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&req)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	hnd := NewHipChatHandler("secret", "support", "yellow", HIPCHAT_FORMAT_TEXT)
+	hnd.Notifier().(*HipChatNotifier).BaseURL = srv.URL + "/"
+
+	if err := hnd.Deliver(testMessage); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+
+	for _, want := range []string{"From     : Alice <alice@example.com>\n", "Subject  : Printer on fire\n", "It is still burning."} {
+		if !strings.Contains(req.Message, want) {
+			t.Errorf("message %q does not contain %q", req.Message, want)
+		}
+	}
+}
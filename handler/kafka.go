@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaPublisher produces payloads to a Kafka topic, waiting for all in-sync
+// replicas to acknowledge them.
+type KafkaPublisher struct {
+	Brokers []string
+	Topic   string
+
+	writer *kafka.Writer
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, key string, payload []byte, headers map[string]string) error {
+	msg := kafka.Message{
+		Key:   []byte(key),
+		Value: payload}
+
+	for k, v := range headers {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+
+	err := p.writer.WriteMessages(ctx, msg)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return Temporary(fmt.Errorf("Kafka produce failed: %s", err))
+	}
+
+	return nil
+}
+
+func (p *KafkaPublisher) Describe() string {
+	return fmt.Sprintf("KafkaHandler (brokers=%s, topic=%s)", strings.Join(p.Brokers, ","), p.Topic)
+}
+
+// Check connects to the first reachable broker.
+func (p *KafkaPublisher) Check(ctx context.Context) error {
+	var err error
+	for _, broker := range p.Brokers {
+		if err = dialCheck(ctx, broker); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// Close flushes and closes the writer.
+func (p *KafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+func NewKafkaPublisher(brokers []string, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		Brokers: brokers,
+		Topic:   topic,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// messages are produced one at a time, waiting for their
+			// acknowledgement: do not wait for a batch to fill up
+			BatchSize: 1}}
+}
+
+func NewKafkaHandler(brokers []string, topic string, keyTemplate string, format string) *QueueHandler {
+	return NewQueueHandler(NewKafkaPublisher(brokers, topic), keyTemplate, format)
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestNewKafkaPublisher(t *testing.T) {
+	tests := []struct {
+		name    string
+		brokers string
+		topic   string
+	}{
+		{"single broker", "kafka:9092", "mail"},
+		{"several brokers", "kafka-1:9092,kafka-2:9092", "tickets"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hnd := NewKafkaHandler(strings.Split(tt.brokers, ","), tt.topic, "{To}", QUEUE_FORMAT_RAW)
+			p := hnd.Publisher().(*KafkaPublisher)
+			defer hnd.Close()
+
+			if p.writer.Addr.String() != tt.brokers {
+				t.Errorf("writer addr = %q, want %q", p.writer.Addr, tt.brokers)
+			}
+			if p.writer.Topic != tt.topic {
+				t.Errorf("writer topic = %q, want %q", p.writer.Topic, tt.topic)
+			}
+			if p.writer.RequiredAcks != kafka.RequireAll {
+				t.Errorf("writer acks = %v, want all", p.writer.RequiredAcks)
+			}
+			// a single message must not wait for a batch to fill up
+			if p.writer.BatchSize != 1 {
+				t.Errorf("writer batch size = %d, want 1", p.writer.BatchSize)
+			}
+			if desc := hnd.Describe(); !strings.Contains(desc, "brokers="+tt.brokers) || !strings.Contains(desc, "topic="+tt.topic) {
+				t.Errorf("Describe() = %q", desc)
+			}
+		})
+	}
+}
+
+func TestKafkaPublisherCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	defer l.Close()
+
+	tests := []struct {
+		name    string
+		brokers []string
+		wantErr bool
+	}{
+		{"reachable broker", []string{l.Addr().String()}, false},
+		{"first broker down", []string{closedAddr(t), l.Addr().String()}, false},
+		{"all brokers down", []string{closedAddr(t)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewKafkaPublisher(tt.brokers, "mail")
+			defer p.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := p.Check(ctx); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKafkaPublisherPublish(t *testing.T) {
+	tests := []struct {
+		name   string
+		closed bool
+	}{
+		{"unreachable broker", false},
+		{"closed publisher", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewKafkaPublisher([]string{closedAddr(t)}, "mail")
+			if tt.closed {
+				if err := p.Close(); err != nil {
+					t.Fatalf("Close() error = %v", err)
+				}
+			} else {
+				defer p.Close()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			err := p.Publish(ctx, "key", []byte(testMessage), map[string]string{"Message-Id": "<1234@example.com>"})
+			if err == nil {
+				t.Fatalf("Publish() succeeded")
+			}
+			if !IsTemporary(err) {
+				t.Errorf("Publish() error = %v, want a temporary error", err)
+			}
+		})
+	}
+}
@@ -1,13 +1,33 @@
 package handler
 
-import "log"
+import (
+	"context"
+	"log/slog"
+)
 
+// LoggerHandler logs incoming messages, with logger or else with the logger
+// of the delivery context.
 type LoggerHandler struct {
-	logger *log.Logger
+	logger *slog.Logger
 }
 
 func (hnd *LoggerHandler) Deliver(message string) error {
-	hnd.logger.Printf("Message:\n%q", message)
+	return hnd.DeliverMessage(NewMessage([]byte(message)))
+}
+
+func (hnd *LoggerHandler) DeliverMessage(msg *Message) error {
+	return hnd.DeliverContext(context.Background(), msg)
+}
+
+func (hnd *LoggerHandler) DeliverContext(ctx context.Context, msg *Message) error {
+	logger := hnd.logger
+	if logger == nil {
+		logger = Logger(ctx)
+	}
+
+	// the body only shows at debug level, see the redact package
+	logger.Info("message", "size", len(msg.Raw))
+	logger.Debug("message body", "body", msg.String())
 
 	return nil
 }
@@ -16,6 +36,6 @@ func (hnd *LoggerHandler) Describe() string {
 	return "Logger Handler"
 }
 
-func NewLoggerHandler(out *log.Logger) *LoggerHandler {
+func NewLoggerHandler(out *slog.Logger) *LoggerHandler {
 	return &LoggerHandler{logger: out}
 }
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"bytes"
+	"net/mail"
+	"sync"
+
+	"github.com/vjeantet/go.enmime"
+)
+
+// Message is an incoming email message along with its delivery context. The
+// same Message goes through every handler of a chain, so it is parsed at most
+// once and handlers may pass results along using Tags and Metadata.
+type Message struct {
+	Raw      []byte
+	UID      uint32
+	Mailbox  string
+	Account  string
+	Tags     []string
+	Metadata map[string]string
+
+	headerOnce sync.Once
+	header     mail.Header
+	headerErr  error
+
+	mimeOnce sync.Once
+	mime     *enmime.MIMEBody
+	mimeErr  error
+}
+
+// String returns the raw message.
+func (m *Message) String() string {
+	return string(m.Raw)
+}
+
+// Header returns the parsed message headers.
+func (m *Message) Header() (mail.Header, error) {
+	m.headerOnce.Do(func() {
+		var mailMessage *mail.Message
+		mailMessage, m.headerErr = mail.ReadMessage(bytes.NewReader(m.Raw))
+		if m.headerErr == nil {
+			m.header = mailMessage.Header
+		}
+	})
+
+	return m.header, m.headerErr
+}
+
+// MIME returns the parsed MIME body of the message. The body is only parsed
+// the first time it is asked for, a message with a broken body may still have
+// valid headers.
+func (m *Message) MIME() (*enmime.MIMEBody, error) {
+	m.mimeOnce.Do(func() {
+		var mailMessage *mail.Message
+		mailMessage, m.mimeErr = mail.ReadMessage(bytes.NewReader(m.Raw))
+		if m.mimeErr == nil {
+			m.mime, m.mimeErr = enmime.ParseMIMEBody(mailMessage)
+		}
+	})
+
+	return m.mime, m.mimeErr
+}
+
+// AddTag tags the message, once.
+func (m *Message) AddTag(tag string) {
+	if !m.HasTag(tag) {
+		m.Tags = append(m.Tags, tag)
+	}
+}
+
+// HasTag reports whether the message has been tagged with tag.
+func (m *Message) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Set stores a metadata value for the next handlers of the chain.
+func (m *Message) Set(key string, value string) {
+	if m.Metadata == nil {
+		m.Metadata = map[string]string{}
+	}
+	m.Metadata[key] = value
+}
+
+// Get returns a metadata value set by a previous handler of the chain.
+func (m *Message) Get(key string) string {
+	return m.Metadata[key]
+}
+
+func NewMessage(raw []byte) *Message {
+	return &Message{
+		Raw:      raw,
+		Metadata: map[string]string{}}
+}
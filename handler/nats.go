@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/etrepat/postman/redact"
+	"github.com/nats-io/nats.go"
+)
+
+// NatsPublisher publishes payloads to a NATS JetStream subject, waiting for
+// the stream acknowledgement.
+type NatsPublisher struct {
+	Url     string
+	Subject string
+
+	mu     sync.Mutex
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	closed bool
+}
+
+func (p *NatsPublisher) Publish(ctx context.Context, key string, payload []byte, headers map[string]string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.connect(); err != nil {
+		return Temporary(fmt.Errorf("Could not connect to NATS server: %s", err))
+	}
+
+	msg := nats.NewMsg(p.subject(key))
+	msg.Data = payload
+	for k, v := range headers {
+		msg.Header.Set(k, v)
+	}
+
+	opts := []nats.PubOpt{nats.Context(ctx)}
+	if id := headers["Message-Id"]; id != "" {
+		// lets JetStream discard duplicates of redelivered messages
+		opts = append(opts, nats.MsgId(id))
+	}
+
+	_, err := p.js.PublishMsg(msg, opts...)
+	if errors.Is(err, nats.ErrNoStreamResponse) {
+		return fmt.Errorf("No JetStream stream is bound to subject %s", msg.Subject)
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return Temporary(fmt.Errorf("NATS publish failed: %s", err))
+	}
+
+	return nil
+}
+
+func (p *NatsPublisher) Describe() string {
+	return fmt.Sprintf("NatsHandler (url=%s, subject=%s)", redact.URL(p.Url), p.Subject)
+}
+
+// subject joins the configured subject and the routing key with a "." token
+// separator, either one may be empty.
+func (p *NatsPublisher) subject(key string) string {
+	if p.Subject == "" {
+		return key
+	} else if key == "" {
+		return p.Subject
+	}
+
+	return p.Subject + "." + key
+}
+
+// Check connects to the server, unless already connected.
+func (p *NatsPublisher) Check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.connect()
+}
+
+// Close closes the connection to the server, for good.
+func (p *NatsPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn, p.js = nil, nil
+
+	return nil
+}
+
+func (p *NatsPublisher) connect() error {
+	if p.closed {
+		return fmt.Errorf("publisher closed")
+	} else if p.conn != nil && !p.conn.IsClosed() {
+		return nil
+	}
+
+	conn, err := nats.Connect(p.Url, nats.Name("postman"))
+	if err != nil {
+		return err
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.conn = conn
+	p.js = js
+
+	return nil
+}
+
+func NewNatsPublisher(url string, subject string) *NatsPublisher {
+	return &NatsPublisher{
+		Url:     url,
+		Subject: subject}
+}
+
+func NewNatsHandler(url string, subject string, keyTemplate string, format string) *QueueHandler {
+	return NewQueueHandler(NewNatsPublisher(url, subject), keyTemplate, format)
+}
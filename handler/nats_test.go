@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// runNatsServer starts an embedded NATS server with JetStream, and a stream
+// bound to the "mail.>" subjects.
+func runNatsServer(t *testing.T) (*server.Server, nats.JetStreamContext) {
+	t.Helper()
+
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true})
+	if err != nil {
+		t.Fatalf("could not create NATS server: %s", err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("NATS server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+
+	conn, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("could not connect to NATS server: %s", err)
+	}
+	t.Cleanup(conn.Close)
+
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatalf("could not get JetStream context: %s", err)
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:       "MAIL",
+		Subjects:   []string{"mail.>"},
+		Duplicates: time.Minute})
+	if err != nil {
+		t.Fatalf("could not create stream: %s", err)
+	}
+
+	return srv, js
+}
+
+func TestNatsHandlerDeliver(t *testing.T) {
+	srv, js := runNatsServer(t)
+
+	tests := []struct {
+		name        string
+		subject     string
+		keyTemplate string
+		format      string
+		message     string
+		want        string
+		contentType string
+		temporary   bool
+		wantErr     bool
+	}{
+		{
+			name:        "raw message",
+			subject:     "mail",
+			keyTemplate: "{To}",
+			format:      QUEUE_FORMAT_RAW,
+			message:     testMessage,
+			want:        "mail.support@example_com",
+			contentType: "message/rfc822",
+		},
+		{
+			name:        "json message",
+			subject:     "mail.json",
+			keyTemplate: "",
+			format:      QUEUE_FORMAT_JSON,
+			message:     strings.Replace(testMessage, "<1234@", "<5678@", 1),
+			want:        "mail.json",
+			contentType: "application/json",
+		},
+		{
+			name:        "subject from key only",
+			subject:     "",
+			keyTemplate: "mail.{Subject}",
+			format:      QUEUE_FORMAT_RAW,
+			message:     strings.Replace(testMessage, "<1234@", "<9012@", 1),
+			want:        "mail.Printer_on_fire",
+			contentType: "message/rfc822",
+		},
+		{
+			name:        "no stream bound",
+			subject:     "other",
+			keyTemplate: "",
+			format:      QUEUE_FORMAT_RAW,
+			message:     testMessage,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hnd := NewNatsHandler(srv.ClientURL(), tt.subject, tt.keyTemplate, tt.format)
+			defer hnd.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err := hnd.DeliverContext(ctx, NewMessage([]byte(tt.message)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeliverContext() error = %v, wantErr %v", err, tt.wantErr)
+			} else if err != nil {
+				if IsTemporary(err) != tt.temporary {
+					t.Errorf("IsTemporary(%v) = %v, want %v", err, IsTemporary(err), tt.temporary)
+				}
+				return
+			}
+
+			msg, err := js.GetLastMsg("MAIL", tt.want)
+			if err != nil {
+				t.Fatalf("no message published to %s: %s", tt.want, err)
+			}
+			if got := msg.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := msg.Header.Get("Subject"); got != "Printer on fire" {
+				t.Errorf("Subject header = %q", got)
+			}
+			if tt.format == QUEUE_FORMAT_RAW && string(msg.Data) != tt.message {
+				t.Errorf("data = %q, want the raw message", msg.Data)
+			}
+		})
+	}
+}
+
+// TestNatsPublisherDuplicates checks that redeliveries of a message are
+// discarded by JetStream, thanks to its Message-Id.
+func TestNatsPublisherDuplicates(t *testing.T) {
+	srv, js := runNatsServer(t)
+
+	hnd := NewNatsHandler(srv.ClientURL(), "mail", "dup", QUEUE_FORMAT_RAW)
+	defer hnd.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := hnd.Deliver(testMessage); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+
+	info, err := js.StreamInfo("MAIL")
+	if err != nil {
+		t.Fatalf("could not get stream info: %s", err)
+	}
+	if info.State.Msgs != 1 {
+		t.Errorf("stream holds %d messages, want 1", info.State.Msgs)
+	}
+}
+
+func TestNatsPublisherClose(t *testing.T) {
+	srv, _ := runNatsServer(t)
+
+	publisher := NewNatsPublisher(srv.ClientURL(), "mail")
+	if err := publisher.Check(context.Background()); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if err := publisher.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	err := publisher.Publish(context.Background(), "closed", []byte("x"), map[string]string{})
+	if err == nil || !IsTemporary(err) {
+		t.Errorf("Publish() after Close() error = %v, want a temporary error", err)
+	}
+	if err := publisher.Check(context.Background()); err == nil {
+		t.Errorf("Check() after Close() succeeded")
+	}
+}
+
+func TestNatsPublisherSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		key     string
+		want    string
+	}{
+		{"mail", "support", "mail.support"},
+		{"mail", "", "mail"},
+		{"", "support", "support"},
+	}
+
+	for _, tt := range tests {
+		p := NewNatsPublisher("nats://127.0.0.1:4222", tt.subject)
+		if got := p.subject(tt.key); got != tt.want {
+			t.Errorf("subject(%q) with %q = %q, want %q", tt.key, tt.subject, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/jaytaylor/html2text"
+	"github.com/kennygrant/sanitize"
+)
+
+var (
+	allowedTags = []string{"a", "b", "i", "strong", "em", "br", "img", "pre", "code", "li", "table", "ol", "thead", "tr", "th", "tbody", "td"}
+
+	allowedAttributes = []string{"id", "class", "src", "href", "title", "alt", "name", "rel"}
+)
+
+//Notification is a chat friendly rendering of an email message
+type Notification struct {
+	From        string
+	Subject     string
+	Text        string
+	Html        string
+	Inlines     int
+	Attachments int
+	OtherParts  int
+}
+
+//Summary returns a short description of the notification, suitable for logs
+func (n *Notification) Summary() string {
+	return fmt.Sprintf("From: %s, Subject: %s, Text: %d chars, Html: %d chars, Inlines: %d, Attachments: %d, Others: %d",
+		n.From, n.Subject, len(n.Text), len(n.Html), n.Inlines, n.Attachments, n.OtherParts)
+}
+
+//Notifier transports a rendered Notification to a chat target
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+	Describe() string
+}
+
+//NotifierHandler renders incoming messages and hands them to a Notifier
+type NotifierHandler struct {
+	notifier Notifier
+}
+
+//Deliver renders the message and sends it with the notifier
+func (hnd *NotifierHandler) Deliver(message string) error {
+	return hnd.DeliverMessage(NewMessage([]byte(message)))
+}
+
+//DeliverMessage renders the message and sends it with the notifier
+func (hnd *NotifierHandler) DeliverMessage(msg *Message) error {
+	return hnd.DeliverContext(context.Background(), msg)
+}
+
+//DeliverContext renders the message and sends it with the notifier
+func (hnd *NotifierHandler) DeliverContext(ctx context.Context, msg *Message) error {
+	n, err := RenderMessage(msg)
+	if err != nil {
+		return fmt.Errorf("Could not render message: %s", err)
+	}
+
+	Logger(ctx).Info("notification",
+		"from", n.From,
+		"subject", n.Subject,
+		"text_chars", len(n.Text),
+		"html_chars", len(n.Html),
+		"inlines", n.Inlines,
+		"attachments", n.Attachments,
+		"others", n.OtherParts)
+
+	return hnd.notifier.Notify(ctx, n)
+}
+
+//Describe the handler
+func (hnd *NotifierHandler) Describe() string {
+	return hnd.notifier.Describe()
+}
+
+//Check checks the notifier target, when the notifier supports it
+func (hnd *NotifierHandler) Check(ctx context.Context) error {
+	return Check(ctx, hnd.notifier)
+}
+
+//Notifier returns the underlying notifier
+func (hnd *NotifierHandler) Notifier() Notifier {
+	return hnd.notifier
+}
+
+//NewNotifierHandler create the handler
+func NewNotifierHandler(notifier Notifier) *NotifierHandler {
+	return &NotifierHandler{notifier: notifier}
+}
+
+//Render parses a raw email message into a Notification holding both a plain
+//text and a sanitized html variant of its body
+func Render(message string) (*Notification, error) {
+	return RenderMessage(NewMessage([]byte(message)))
+}
+
+//RenderMessage renders an already parsed message
+func RenderMessage(msg *Message) (*Notification, error) {
+	mime, err := msg.MIME()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Notification{
+		From:        mime.GetHeader("From"),
+		Subject:     mime.GetHeader("Subject"),
+		Text:        mime.Text,
+		Inlines:     len(mime.Inlines),
+		Attachments: len(mime.Attachments),
+		OtherParts:  len(mime.OtherParts)}
+
+	if mime.Html != "" {
+		n.Html = sanitizeMessage(mime.Html)
+
+		if n.Text == "" || mime.IsTextFromHtml {
+			n.Text = formatMessage(mime.Html)
+		}
+	}
+
+	return n, nil
+}
+
+//formatMessage converts html into plain text
+func formatMessage(message string) string {
+	text, err := html2text.FromString(message)
+	if err != nil {
+		slog.Warn("failed to convert html to text", "error", err)
+		return message
+	}
+
+	return text
+}
+
+//sanitizeMessage strips any html not supported by chat targets
+func sanitizeMessage(message string) string {
+	text, err := sanitize.HTMLAllowing(message, allowedTags, allowedAttributes)
+	if err != nil {
+		slog.Warn("failed to sanitize html", "error", err)
+		return ""
+	}
+
+	return text
+}
+
+//short truncate message, note not unicode compliant
+func short(s string, i int) string {
+	runes := []rune(s)
+	if len(runes) > i {
+		return string(runes[:i])
+	}
+	return s
+}
@@ -1,13 +1,21 @@
 package handler
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/etrepat/postman/redact"
+	"github.com/etrepat/postman/tracing"
 )
 
+var headerUnsafe = regexp.MustCompile(`[^A-Za-z0-9-]`)
+
 type PostBackHandler struct {
 	Url           string
 	PostEncoded   bool
@@ -15,29 +23,41 @@ type PostBackHandler struct {
 }
 
 func (hnd *PostBackHandler) Deliver(message string) error {
+	return hnd.DeliverMessage(NewMessage([]byte(message)))
+}
+
+func (hnd *PostBackHandler) DeliverMessage(msg *Message) error {
+	return hnd.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext posts the raw message. Its context, including metadata set by
+// previous handlers of the chain, is sent along as X-Postman-* headers.
+func (hnd *PostBackHandler) DeliverContext(ctx context.Context, msg *Message) error {
 	var err error
 
-	req, err := newPostRequest(hnd.Url, hnd.getPostBody(message))
+	req, err := newPostRequest(ctx, hnd.Url, hnd.getPostBody(msg.String()))
 	if err != nil {
 		return fmt.Errorf("Could not deliver: %s", err)
 	}
 
 	req.Header.Add("Content-Type", hnd.getContentType())
+	addContextHeaders(req.Header, msg)
+	tracing.InjectHTTP(ctx, req.Header)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("Request into postback hook failed: %s", err)
+		return Temporary(fmt.Errorf("Request into postback hook failed: %s", err))
 	}
 
 	data, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		return fmt.Errorf("An error occurred while reading hook response: %s", err)
+		return Temporary(fmt.Errorf("An error occurred while reading hook response: %s", err))
 	}
 
 	if !responseOk(resp.StatusCode) {
-		return fmt.Errorf("Hook returned with error: %s\n%q", resp.Status, data)
+		return responseError(resp.StatusCode, fmt.Errorf("Hook returned with error: %s\n%q", resp.Status, data))
 	}
 
 	return nil
@@ -49,7 +69,12 @@ func (hnd *PostBackHandler) Describe() string {
 		desc = fmt.Sprintf("urlencoded[%s]", hnd.PostParamName)
 	}
 
-	return fmt.Sprintf("PostbackHandler (url=%s, %s)", redactedURL(hnd.Url), desc)
+	return fmt.Sprintf("PostbackHandler (url=%s, %s)", redact.URL(hnd.Url), desc)
+}
+
+// Check connects to the postback host.
+func (hnd *PostBackHandler) Check(ctx context.Context) error {
+	return dialURLCheck(ctx, hnd.Url)
 }
 
 func (hnd *PostBackHandler) getPostBody(raw string) string {
@@ -77,14 +102,14 @@ func NewPostBackHandler(postUrl string, postEncoded bool, postParamName string)
 		PostParamName: postParamName}
 }
 
-func newPostRequest(endpoint string, payload string) (*http.Request, error) {
+func newPostRequest(ctx context.Context, endpoint string, payload string) (*http.Request, error) {
 	uri, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("Malformed postback hook url: %s", err)
 	}
 
 	buff := strings.NewReader(payload)
-	req, err := http.NewRequest("POST", endpoint, buff)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, buff)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to build request object: %s", err)
 	}
@@ -96,15 +121,34 @@ func newPostRequest(endpoint string, payload string) (*http.Request, error) {
 	return req, nil
 }
 
+func addContextHeaders(header http.Header, msg *Message) {
+	if msg.UID != 0 {
+		header.Add("X-Postman-Uid", strconv.FormatUint(uint64(msg.UID), 10))
+	}
+	if msg.Mailbox != "" {
+		header.Add("X-Postman-Mailbox", msg.Mailbox)
+	}
+	if msg.Account != "" {
+		header.Add("X-Postman-Account", msg.Account)
+	}
+	if len(msg.Tags) > 0 {
+		header.Add("X-Postman-Tags", strings.Join(msg.Tags, ","))
+	}
+	for key, value := range msg.Metadata {
+		header.Add("X-Postman-Meta-"+headerUnsafe.ReplaceAllString(key, "-"), value)
+	}
+}
+
 func responseOk(status int) bool {
 	return !(status != 200 && status != 201 && status != 204)
 }
 
-func redactedURL(u string) string {
-	uri, err := url.Parse(u)
-	if err != nil {
-		return u
+// responseError marks err temporary when the status is worth retrying: server
+// errors, timeouts and rate limiting.
+func responseError(status int, err error) error {
+	if status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests {
+		return Temporary(err)
 	}
 
-	return uri.Scheme + "://" + uri.Host + uri.Path
+	return err
 }
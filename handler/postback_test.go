@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPostBackHandlerDeliver(t *testing.T) {
+	tests := []struct {
+		name      string
+		encoded   bool
+		status    int
+		wantErr   bool
+		temporary bool
+	}{
+		{name: "plain", status: http.StatusOK},
+		{name: "urlencoded", encoded: true, status: http.StatusCreated},
+		{name: "bad request", status: http.StatusBadRequest, wantErr: true},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true, temporary: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantErr: true, temporary: true},
+		{name: "rate limited", status: http.StatusTooManyRequests, wantErr: true, temporary: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var contentType string
+			var body []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				contentType = r.Header.Get("Content-Type")
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			hnd := NewPostBackHandler(srv.URL, tt.encoded, "message")
+			err := hnd.DeliverContext(context.Background(), NewMessage([]byte(testMessage)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeliverContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if IsTemporary(err) != tt.temporary {
+					t.Errorf("IsTemporary(%v) = %v, want %v", err, IsTemporary(err), tt.temporary)
+				}
+				return
+			}
+
+			raw := string(body)
+			if tt.encoded {
+				values, _ := url.ParseQuery(raw)
+				raw = values.Get("message")
+			}
+			if raw != testMessage {
+				t.Errorf("posted %q, want the raw message", body)
+			}
+			if contentType != hnd.getContentType() {
+				t.Errorf("Content-Type = %q, want %q", contentType, hnd.getContentType())
+			}
+		})
+	}
+}
+
+func TestPostBackHandlerUnreachable(t *testing.T) {
+	hnd := NewPostBackHandler("http://"+closedAddr(t)+"/hook", false, "")
+
+	err := hnd.DeliverContext(context.Background(), NewMessage([]byte(testMessage)))
+	if err == nil || !IsTemporary(err) {
+		t.Errorf("DeliverContext() error = %v, want a temporary error", err)
+	}
+}
@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/etrepat/postman/tracing"
+)
+
+const (
+	QUEUE_FORMAT_RAW  = "raw"
+	QUEUE_FORMAT_JSON = "json"
+)
+
+var (
+	QUEUE_FORMATS = map[string]bool{
+		QUEUE_FORMAT_RAW:  true,
+		QUEUE_FORMAT_JSON: true}
+
+	// {Header-Name} placeholders in routing key templates
+	routingKeyPlaceholder = regexp.MustCompile(`\{([A-Za-z0-9-]+)\}`)
+	routingKeyUnsafe      = regexp.MustCompile(`[^A-Za-z0-9_@-]+`)
+
+	addressHeaders = map[string]bool{
+		"From":     true,
+		"To":       true,
+		"Cc":       true,
+		"Reply-To": true,
+		"Sender":   true}
+)
+
+// Publisher sends a payload to a message broker. Publish must only return
+// once the broker has acknowledged the payload.
+type Publisher interface {
+	Publish(ctx context.Context, key string, payload []byte, headers map[string]string) error
+	Describe() string
+}
+
+// QueuePayload is the JSON structured representation of a message.
+type QueuePayload struct {
+	UID       uint32              `json:"uid,omitempty"`
+	Mailbox   string              `json:"mailbox,omitempty"`
+	Account   string              `json:"account,omitempty"`
+	MessageId string              `json:"message_id"`
+	From      string              `json:"from"`
+	To        string              `json:"to"`
+	Subject   string              `json:"subject"`
+	Date      string              `json:"date"`
+	Headers   map[string][]string `json:"headers"`
+	Text      string              `json:"text"`
+	Html      string              `json:"html"`
+	Metadata  map[string]string   `json:"metadata,omitempty"`
+	Raw       string              `json:"raw"`
+}
+
+type QueueHandler struct {
+	KeyTemplate string
+	Format      string
+
+	publisher Publisher
+}
+
+func (hnd *QueueHandler) Deliver(message string) error {
+	return hnd.DeliverContext(context.Background(), NewMessage([]byte(message)))
+}
+
+func (hnd *QueueHandler) DeliverMessage(msg *Message) error {
+	return hnd.DeliverContext(context.Background(), msg)
+}
+
+func (hnd *QueueHandler) DeliverContext(ctx context.Context, msg *Message) error {
+	header, err := msg.Header()
+	if err != nil {
+		return fmt.Errorf("Could not parse message: %s", err)
+	}
+
+	payload := msg.Raw
+	contentType := "message/rfc822"
+
+	if hnd.Format == QUEUE_FORMAT_JSON {
+		payload, err = jsonPayload(header, msg)
+		if err != nil {
+			return fmt.Errorf("Could not encode message: %s", err)
+		}
+		contentType = "application/json"
+	}
+
+	headers := map[string]string{
+		"Content-Type": contentType,
+		"Message-Id":   header.Get("Message-Id"),
+		"Subject":      header.Get("Subject"),
+		"From":         header.Get("From")}
+	tracing.Inject(ctx, headers)
+
+	return hnd.publisher.Publish(ctx, RoutingKey(hnd.KeyTemplate, header), payload, headers)
+}
+
+func (hnd *QueueHandler) Describe() string {
+	return fmt.Sprintf("%s (key=%q, %s)", hnd.publisher.Describe(), hnd.KeyTemplate, hnd.Format)
+}
+
+// Check checks the publisher broker, when the publisher supports it.
+func (hnd *QueueHandler) Check(ctx context.Context) error {
+	return Check(ctx, hnd.publisher)
+}
+
+// Close closes the connection of the publisher to its broker.
+func (hnd *QueueHandler) Close() error {
+	if closer, ok := hnd.publisher.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func (hnd *QueueHandler) Publisher() Publisher {
+	return hnd.publisher
+}
+
+func NewQueueHandler(publisher Publisher, keyTemplate string, format string) *QueueHandler {
+	return &QueueHandler{
+		KeyTemplate: keyTemplate,
+		Format:      format,
+		publisher:   publisher}
+}
+
+func QueueFormatValid(format string) bool {
+	return QUEUE_FORMATS[format]
+}
+
+// RoutingKey expands {Header-Name} placeholders of template with the values
+// of the message headers. Address headers expand to their first address.
+// Expanded values only keep characters which are safe in routing keys and
+// subjects, ie: "mail.{To}" expands to "mail.support@example_com".
+func RoutingKey(template string, header mail.Header) string {
+	return routingKeyPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := strings.Trim(placeholder, "{}")
+		value := header.Get(name)
+
+		if addressHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			if addrs, err := header.AddressList(name); err == nil && len(addrs) > 0 {
+				value = addrs[0].Address
+			}
+		}
+
+		value = strings.Trim(routingKeyUnsafe.ReplaceAllString(value, "_"), "_")
+		if value == "" {
+			return "unknown"
+		}
+
+		return value
+	})
+}
+
+func jsonPayload(header mail.Header, msg *Message) ([]byte, error) {
+	payload := &QueuePayload{
+		UID:       msg.UID,
+		Mailbox:   msg.Mailbox,
+		Account:   msg.Account,
+		MessageId: header.Get("Message-Id"),
+		From:      header.Get("From"),
+		To:        header.Get("To"),
+		Subject:   header.Get("Subject"),
+		Date:      header.Get("Date"),
+		Headers:   map[string][]string(header),
+		Metadata:  msg.Metadata,
+		Raw:       msg.String()}
+
+	if n, err := RenderMessage(msg); err == nil {
+		payload.Text = n.Text
+		payload.Html = n.Html
+	}
+
+	return json.Marshal(payload)
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Handler stores raw messages and their attachments into an S3 compatible
+// object storage (AWS S3, MinIO, ...) using the following key scheme:
+//
+//	{account}/{mailbox}/{date}/{uid}.eml
+//	{account}/{mailbox}/{date}/{uid}/{index}-{attachment filename}
+//
+// A digest of the Message-Id header replaces the uid of messages which do not
+// come from an IMAP mailbox. The 1-based index of attachments keeps those
+// sharing a filename apart.
+type S3Handler struct {
+	Endpoint string
+	Bucket   string
+	Account  string
+	Mailbox  string
+
+	client *minio.Client
+}
+
+func (hnd *S3Handler) Deliver(message string) error {
+	return hnd.DeliverMessage(NewMessage([]byte(message)))
+}
+
+func (hnd *S3Handler) DeliverMessage(msg *Message) error {
+	return hnd.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext stores the message and its attachments, and passes their urls
+// on to the next handlers as the "s3.url" and "s3.attachments" (space
+// separated) metadata.
+func (hnd *S3Handler) DeliverContext(ctx context.Context, msg *Message) error {
+	header, err := msg.Header()
+	if err != nil {
+		return fmt.Errorf("Could not parse message: %s", err)
+	}
+
+	date, err := header.Date()
+	if err != nil {
+		date = time.Now()
+	}
+
+	account, mailbox := hnd.Account, hnd.Mailbox
+	if msg.Account != "" {
+		account = msg.Account
+	}
+	if msg.Mailbox != "" {
+		mailbox = msg.Mailbox
+	}
+
+	id := fmt.Sprintf("%d", msg.UID)
+	if msg.UID == 0 {
+		id = messageKey(header.Get("Message-Id"), msg.String())
+	}
+
+	prefix := S3Prefix(account, mailbox, date, id)
+
+	u, err := hnd.put(ctx, prefix+".eml", msg.Raw, "message/rfc822")
+	if err != nil {
+		return err
+	}
+	msg.Set("s3.url", u)
+
+	mime, err := msg.MIME()
+	if err != nil {
+		return fmt.Errorf("Could not parse message attachments: %s", err)
+	}
+
+	urls := []string{}
+	for i, attachment := range mime.Attachments {
+		key := fmt.Sprintf("%s/%d-%s", prefix, i+1, attachmentName(attachment.FileName()))
+		u, err = hnd.put(ctx, key, attachment.Content(), attachment.ContentType())
+		if err != nil {
+			return err
+		}
+		urls = append(urls, u)
+	}
+	msg.Set("s3.attachments", strings.Join(urls, " "))
+
+	Logger(ctx).Info("stored message", "url", msg.Get("s3.url"), "attachments", len(urls))
+
+	return nil
+}
+
+func (hnd *S3Handler) Describe() string {
+	return fmt.Sprintf("S3Handler (endpoint=%s, bucket=%s)", hnd.Endpoint, hnd.Bucket)
+}
+
+// Check makes sure the bucket exists and is accessible.
+func (hnd *S3Handler) Check(ctx context.Context) error {
+	ok, err := hnd.client.BucketExists(ctx, hnd.Bucket)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("Bucket %s does not exist", hnd.Bucket)
+	}
+
+	return nil
+}
+
+// URL returns the url of the object stored under key.
+func (hnd *S3Handler) URL(key string) string {
+	u := *hnd.client.EndpointURL()
+	u.Path = "/" + hnd.Bucket + "/" + key
+
+	return u.String()
+}
+
+func (hnd *S3Handler) put(ctx context.Context, key string, data []byte, contentType string) (string, error) {
+	_, err := hnd.client.PutObject(ctx, hnd.Bucket, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		failure := fmt.Errorf("Could not store %s into bucket %s: %s", key, hnd.Bucket, err)
+		if s3Temporary(err) {
+			return "", Temporary(failure)
+		}
+		return "", failure
+	}
+
+	return hnd.URL(key), nil
+}
+
+// s3Temporary reports whether a failed S3 request is worth retrying: network
+// failures, server errors and throttling are, while a missing bucket or denied
+// access would fail again the same way.
+func s3Temporary(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	switch {
+	case resp.StatusCode == 0:
+		return true
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	}
+
+	switch resp.Code {
+	case "RequestTimeout", "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "ExpiredToken":
+		return true
+	}
+
+	return false
+}
+
+// S3Prefix returns the key of a message, without extension.
+func S3Prefix(account string, mailbox string, date time.Time, id string) string {
+	return path.Join(account, mailbox, date.UTC().Format("2006-01-02"), id)
+}
+
+// messageKey identifies a message by a digest of its Message-Id header, or of
+// its whole content when there is none.
+func messageKey(messageId string, raw string) string {
+	if messageId == "" {
+		messageId = raw
+	}
+
+	return fmt.Sprintf("%x", sha1.Sum([]byte(messageId)))
+}
+
+// attachmentName strips the directories off the filename of an attachment.
+func attachmentName(name string) string {
+	name = strings.Trim(path.Base(strings.Replace(name, "\\", "/", -1)), ".")
+	if name == "" || name == "/" {
+		name = "attachment"
+	}
+
+	return name
+}
+
+func NewS3Handler(endpoint string, ssl bool, region string, accessKey string, secretKey string, bucket string, account string, mailbox string) (*S3Handler, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: ssl,
+		Region: region})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3 endpoint %s: %s", endpoint, err)
+	}
+
+	return &S3Handler{
+		Endpoint: endpoint,
+		Bucket:   bucket,
+		Account:  account,
+		Mailbox:  mailbox,
+		client:   client}, nil
+}
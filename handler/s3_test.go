@@ -0,0 +1,389 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// fakeS3 is an S3 stand-in keeping the objects put into its buckets.
+type fakeS3 struct {
+	mu           sync.Mutex
+	buckets      map[string]bool
+	objects      map[string][]byte
+	contentTypes map[string]string
+}
+
+func newFakeS3(buckets ...string) (*fakeS3, *httptest.Server) {
+	s3 := &fakeS3{
+		buckets:      map[string]bool{},
+		objects:      map[string][]byte{},
+		contentTypes: map[string]string{}}
+	for _, bucket := range buckets {
+		s3.buckets[bucket] = true
+	}
+
+	return s3, httptest.NewServer(s3)
+}
+
+func (s3 *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !s3.buckets[bucket] {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `<Error><Code>NoSuchBucket</Code><Message>no such bucket</Message></Error>`)
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key != "" && r.Method == http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s3.objects[bucket+"/"+key] = data
+		s3.contentTypes[bucket+"/"+key] = r.Header.Get("Content-Type")
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (s3 *fakeS3) object(key string) ([]byte, string, bool) {
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+
+	data, ok := s3.objects[key]
+	return data, s3.contentTypes[key], ok
+}
+
+// readS3Body reads the object of a PUT request, decoding the aws-chunked
+// encoding of streaming signatures.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data bytes.Buffer
+	body := bufio.NewReader(r.Body)
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		} else if n == 0 {
+			return data.Bytes(), nil
+		}
+		if _, err := io.CopyN(&data, body, n); err != nil {
+			return nil, err
+		}
+		body.ReadString('\n')
+	}
+}
+
+func newTestS3Handler(t *testing.T, srv *httptest.Server) *S3Handler {
+	t.Helper()
+
+	hnd, err := NewS3Handler(strings.TrimPrefix(srv.URL, "http://"), false, "us-east-1", "access", "secret", "mail", "me@example.com", "INBOX")
+	if err != nil {
+		t.Fatalf("NewS3Handler() error = %v", err)
+	}
+
+	return hnd
+}
+
+func TestS3HandlerDeliver(t *testing.T) {
+	s3, srv := newFakeS3("mail")
+	defer srv.Close()
+	hnd := newTestS3Handler(t, srv)
+
+	tests := []struct {
+		name    string
+		message string
+		uid     uint32
+		account string
+		mailbox string
+		key     string
+	}{
+		{
+			name:    "imap message",
+			message: testMessage,
+			uid:     42,
+			account: "support@example.com",
+			mailbox: "Tickets",
+			key:     "support@example.com/Tickets/2006-01-02/42.eml",
+		},
+		{
+			name:    "handler account and mailbox",
+			message: testMessage,
+			uid:     7,
+			key:     "me@example.com/INBOX/2006-01-02/7.eml",
+		},
+		{
+			name:    "message-id digest without uid",
+			message: testMessage,
+			key:     "me@example.com/INBOX/2006-01-02/" + messageKey("<1234@example.com>", testMessage) + ".eml",
+		},
+		{
+			name:    "date in utc",
+			message: strings.Replace(testMessage, "15:04:05 -0700", "23:30:00 -0300", 1),
+			uid:     8,
+			key:     "me@example.com/INBOX/2006-01-03/8.eml",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewMessage([]byte(tt.message))
+			msg.UID = tt.uid
+			msg.Account = tt.account
+			msg.Mailbox = tt.mailbox
+
+			if err := hnd.DeliverContext(context.Background(), msg); err != nil {
+				t.Fatalf("DeliverContext() error = %v", err)
+			}
+
+			data, contentType, ok := s3.object("mail/" + tt.key)
+			if !ok {
+				t.Fatalf("no object stored under %s, got %v", tt.key, s3.objects)
+			}
+			if string(data) != tt.message {
+				t.Errorf("object = %q, want the raw message", data)
+			}
+			if contentType != "message/rfc822" {
+				t.Errorf("content type = %q, want message/rfc822", contentType)
+			}
+
+			if url := msg.Get("s3.url"); url != srv.URL+"/mail/"+tt.key {
+				t.Errorf("s3.url = %q, want %q", url, srv.URL+"/mail/"+tt.key)
+			}
+			if attachments := msg.Get("s3.attachments"); attachments != "" {
+				t.Errorf("s3.attachments = %q, want none", attachments)
+			}
+		})
+	}
+}
+
+// TestS3HandlerAttachments checks that attachments sharing a filename are
+// stored under distinct keys.
+func TestS3HandlerAttachments(t *testing.T) {
+	s3, srv := newFakeS3("mail")
+	defer srv.Close()
+	hnd := newTestS3Handler(t, srv)
+
+	message := "From: Alice <alice@example.com>\r\n" +
+		"Subject: Screenshots\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 -0700\r\n" +
+		"Content-Type: multipart/mixed; boundary=frontier\r\n" +
+		"\r\n" +
+		"--frontier\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--frontier\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Disposition: attachment; filename=image.png\r\n" +
+		"\r\n" +
+		"first\r\n" +
+		"--frontier\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Disposition: attachment; filename=image.png\r\n" +
+		"\r\n" +
+		"second\r\n" +
+		"--frontier--\r\n"
+
+	msg := NewMessage([]byte(message))
+	msg.UID = 42
+	if err := hnd.DeliverContext(context.Background(), msg); err != nil {
+		t.Fatalf("DeliverContext() error = %v", err)
+	}
+
+	prefix := "mail/me@example.com/INBOX/2006-01-02/42/"
+	urls := []string{}
+	for key, want := range map[string]string{"1-image.png": "first", "2-image.png": "second"} {
+		data, contentType, ok := s3.object(prefix + key)
+		if !ok {
+			t.Fatalf("no object stored under %s", prefix+key)
+		}
+		if string(data) != want || contentType != "image/png" {
+			t.Errorf("%s = %q (%s), want %q", key, data, contentType, want)
+		}
+		urls = append(urls, srv.URL+"/"+prefix+key)
+	}
+
+	if got := strings.Fields(msg.Get("s3.attachments")); len(got) != 2 || got[0] == got[1] {
+		t.Errorf("s3.attachments = %q, want %q", msg.Get("s3.attachments"), urls)
+	}
+}
+
+// TestS3HandlerChain checks that the urls of stored messages are passed on to
+// the next handlers of the chain.
+func TestS3HandlerChain(t *testing.T) {
+	_, srv := newFakeS3("mail")
+	defer srv.Close()
+	hnd := newTestS3Handler(t, srv)
+
+	var header http.Header
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer hook.Close()
+
+	msg := NewMessage([]byte(testMessage))
+	msg.UID = 42
+	for _, h := range []ContextHandler{hnd, NewPostBackHandler(hook.URL, false, "")} {
+		if err := h.DeliverContext(context.Background(), msg); err != nil {
+			t.Fatalf("%s: DeliverContext() error = %v", h.Describe(), err)
+		}
+	}
+
+	want := srv.URL + "/mail/me@example.com/INBOX/2006-01-02/42.eml"
+	if got := header.Get("X-Postman-Meta-S3-Url"); got != want {
+		t.Errorf("X-Postman-Meta-S3-Url = %q, want %q", got, want)
+	}
+}
+
+func TestS3HandlerDeliverMissingBucket(t *testing.T) {
+	_, srv := newFakeS3("mail")
+	defer srv.Close()
+	hnd := newTestS3Handler(t, srv)
+	hnd.Bucket = "missing"
+
+	err := hnd.DeliverContext(context.Background(), NewMessage([]byte(testMessage)))
+	if err == nil {
+		t.Fatalf("DeliverContext() succeeded")
+	}
+	if IsTemporary(err) {
+		t.Errorf("DeliverContext() error = %v, want a permanent error", err)
+	}
+}
+
+func TestS3Temporary(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network failure", errors.New("dial tcp: connection refused"), true},
+		{"internal error", minio.ErrorResponse{StatusCode: http.StatusInternalServerError, Code: "InternalError"}, true},
+		{"unavailable", minio.ErrorResponse{StatusCode: http.StatusServiceUnavailable, Code: "SlowDown"}, true},
+		{"too many requests", minio.ErrorResponse{StatusCode: http.StatusTooManyRequests}, true},
+		{"expired token", minio.ErrorResponse{StatusCode: http.StatusBadRequest, Code: "ExpiredToken"}, true},
+		{"access denied", minio.ErrorResponse{StatusCode: http.StatusForbidden, Code: "AccessDenied"}, false},
+		{"invalid access key", minio.ErrorResponse{StatusCode: http.StatusForbidden, Code: "InvalidAccessKeyId"}, false},
+		{"no such bucket", minio.ErrorResponse{StatusCode: http.StatusNotFound, Code: "NoSuchBucket"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := s3Temporary(tt.err); got != tt.want {
+			t.Errorf("s3Temporary(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestS3HandlerCheck(t *testing.T) {
+	_, srv := newFakeS3("mail")
+	defer srv.Close()
+
+	tests := []struct {
+		bucket  string
+		wantErr bool
+	}{
+		{"mail", false},
+		{"missing", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.bucket, func(t *testing.T) {
+			hnd := newTestS3Handler(t, srv)
+			hnd.Bucket = tt.bucket
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := hnd.Check(ctx); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewS3Handler(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		wantErr  bool
+	}{
+		{"s3.amazonaws.com", false},
+		{"minio.local:9000", false},
+		{"minio local", true},
+		{"http://minio.local:9000", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			_, err := NewS3Handler(tt.endpoint, true, "", "access", "secret", "mail", "", "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewS3Handler(%q) error = %v, wantErr %v", tt.endpoint, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestS3Prefix(t *testing.T) {
+	date := time.Date(2006, 1, 2, 23, 0, 0, 0, time.FixedZone("", -3*3600))
+
+	tests := []struct {
+		account string
+		mailbox string
+		id      string
+		want    string
+	}{
+		{"me@example.com", "INBOX", "42", "me@example.com/INBOX/2006-01-03/42"},
+		{"me@example.com", "Archive/2006", "7", "me@example.com/Archive/2006/2006-01-03/7"},
+	}
+
+	for _, tt := range tests {
+		if got := S3Prefix(tt.account, tt.mailbox, date, tt.id); got != tt.want {
+			t.Errorf("S3Prefix(%q, %q, %q) = %q, want %q", tt.account, tt.mailbox, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestAttachmentName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\Users\me\report.pdf`, "report.pdf"},
+		{"", "attachment"},
+		{"..", "attachment"},
+	}
+
+	for _, tt := range tests {
+		if got := attachmentName(tt.name); got != tt.want {
+			t.Errorf("attachmentName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
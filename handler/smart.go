@@ -1,36 +1,36 @@
 package handler
 
 import (
-	"bytes"
-	"log"
-	"net/mail"
-
-	"github.com/vjeantet/go.enmime"
+	"context"
+	"fmt"
 )
 
 type SmartHandler struct {
 }
 
 func (hnd *SmartHandler) Deliver(message string) error {
-	mailMessage, _ := mail.ReadMessage(bytes.NewBufferString(message))
-	mime, _ := enmime.ParseMIMEBody(mailMessage)
-	s := `
-De    : %s
-Sujet : %s
-Text  : %d chars
-Html  : %d chars
-Inlines      : %d
-Attachements : %d
-Others       : %d`
-	log.Printf(s,
-		mime.GetHeader("From"),
-		mime.GetHeader("Subject"),
-		len(mime.Text),
-		len(mime.Html),
-		len(mime.Inlines),
-		len(mime.Attachments),
-		len(mime.OtherParts),
-	)
+	return hnd.DeliverMessage(NewMessage([]byte(message)))
+}
+
+func (hnd *SmartHandler) DeliverMessage(msg *Message) error {
+	return hnd.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext logs a summary of the message parts.
+func (hnd *SmartHandler) DeliverContext(ctx context.Context, msg *Message) error {
+	mime, err := msg.MIME()
+	if err != nil {
+		return fmt.Errorf("Could not parse message: %s", err)
+	}
+
+	Logger(ctx).Info("message summary",
+		"from", mime.GetHeader("From"),
+		"subject", mime.GetHeader("Subject"),
+		"text_chars", len(mime.Text),
+		"html_chars", len(mime.Html),
+		"inlines", len(mime.Inlines),
+		"attachments", len(mime.Attachments),
+		"others", len(mime.OtherParts))
 
 	return nil
 }
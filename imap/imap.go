@@ -1,24 +1,100 @@
 package imap
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/etrepat/postman/secret"
 	"github.com/mxk/go-imap/imap"
+	"golang.org/x/oauth2"
 )
 
 const (
+	// default interval after which IDLE commands are renewed
 	IdleTimeout = 3 * time.Minute
+	// servers may log out clients idling over 30 minutes (RFC 2177)
+	MaxIdleInterval = 29 * time.Minute
+
+	MECHANISM_LOGIN         = "LOGIN"
+	MECHANISM_PLAIN         = "PLAIN"
+	MECHANISM_CRAM_MD5      = "CRAM-MD5"
+	MECHANISM_SCRAM_SHA_1   = "SCRAM-SHA-1"
+	MECHANISM_SCRAM_SHA_256 = "SCRAM-SHA-256"
+	MECHANISM_EXTERNAL      = "EXTERNAL"
+
+	// idlePoll is how often an IDLE checks whether it has been interrupted
+	idlePoll = time.Second
 )
 
 var (
-	DefaultLogger  = log.New(os.Stderr, "[imap ] ", log.LstdFlags)
+	// authentication mechanisms without OAuth2, by order of preference
+	MECHANISMS = []string{
+		MECHANISM_EXTERNAL,
+		MECHANISM_SCRAM_SHA_256,
+		MECHANISM_SCRAM_SHA_1,
+		MECHANISM_PLAIN,
+		MECHANISM_CRAM_MD5,
+		MECHANISM_LOGIN}
+
+	// DefaultLogger receives the protocol debug output of connections not
+	// yet logged in
+	DefaultLogger  = log.New(logWriter{}, "", 0)
 	DefaultLogMask = imap.LogConn | imap.LogCmd
 )
 
+// logWriter forwards the go-imap debug output to a slog logger, at debug
+// level.
+type logWriter struct {
+	logger *slog.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	logger := w.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Debug(strings.TrimRight(string(p), "\n"), "component", "imap")
+
+	return len(p), nil
+}
+
+// Message is a message fetched from the selected mailbox, along with the
+// time span of the FETCH command which brought it.
+type Message struct {
+	UID uint32
+	Raw []byte
+
+	FetchStart time.Time
+	FetchEnd   time.Time
+}
+
+// Mailbox is a mailbox of the account, along with its LIST attributes and,
+// once Status is called, its message counts.
+type Mailbox struct {
+	Name     string
+	Flags    []string
+	Messages uint32
+	Unseen   uint32
+}
+
+// Selectable reports whether the mailbox may hold messages.
+func (m *Mailbox) Selectable() bool {
+	for _, flag := range m.Flags {
+		if strings.EqualFold(flag, "\\Noselect") || strings.EqualFold(flag, "\\NonExistent") {
+			return false
+		}
+	}
+
+	return true
+}
+
 type ImapClient struct {
 	client *imap.Client
 
@@ -27,31 +103,93 @@ type ImapClient struct {
 	Ssl      bool
 	Username string
 	Password string
+	Logger   *slog.Logger
+
+	// authentication mechanism, negotiated when empty
+	Mechanism string
+	// authorization identity, ie: a shared mailbox, when not Username
+	Identity string
+	// one of TLS_IMPLICIT, TLS_STARTTLS, TLS_PLAINTEXT, or derived from
+	// Port and Ssl when empty
+	TLSMode string
+	// certificate authorities of the server, instead of the system ones
+	CAFile string
+	// name verified against the server certificate, instead of Host
+	ServerName string
+	// DEFAULT_TLS_MIN_VERSION when 0
+	MinVersion uint16
+	// sha256/ pins of the public key of the server or of an issuer, see
+	// PublicKeyPin
+	Pins []string
+	// TLS client certificate, ie: for the EXTERNAL mechanism
+	CertFile string
+	KeyFile  string
+
+	// when set, replaces Password on each connection, so that rotated
+	// passwords are picked up
+	PasswordSource secret.Source
+
+	// when set, authenticates with OAuth2 access tokens instead of Password
+	TokenSource oauth2.TokenSource
+
+	// IDLE commands are renewed after IdleInterval, IdleTimeout when 0
+	IdleInterval time.Duration
+	// when set, IDLE commands are interrupted by a NOOP command every
+	// KeepAlive, for NAT gateways and firewalls dropping quiet connections
+	KeepAlive time.Duration
+
+	// why the server stopped serving the connection, see Unavailable
+	unavailable string
 }
 
 func (c *ImapClient) Addr() string {
 	return fmt.Sprintf("%s:%d", c.Host, c.Port)
 }
 
-func (c *ImapClient) Connect() error {
-	var err error
+func (c *ImapClient) Connect() (err error) {
+	mode := c.tlsMode()
+	if mode == TLS_PLAINTEXT && !IsLocalhost(c.Host) {
+		return &ConfigError{fmt.Errorf("Plaintext IMAP connections are only allowed to localhost, not %s.", c.Host)}
+	}
+
+	config, err := c.tlsConfig()
+	if err != nil {
+		return &ConfigError{err}
+	}
+
+	if c.PasswordSource != nil {
+		c.Password, err = c.PasswordSource.Secret()
+		if err != nil {
+			return &ConfigError{fmt.Errorf("Could not read IMAP password: %s", err)}
+		}
+	}
 
-	if c.Port == 993 || c.Ssl == true {
-		c.client, err = imap.DialTLS(c.Addr(), &tls.Config{})
+	c.unavailable = ""
+	if mode == TLS_IMPLICIT {
+		c.client, err = imap.DialTLS(c.Addr(), config)
 	} else {
 		c.client, err = imap.Dial(c.Addr())
 	}
 
 	if err != nil {
-		return fmt.Errorf("IMAP dial error! ", err)
+		return fmt.Errorf("IMAP dial error! %s", err)
 	}
+	defer func() {
+		if err != nil {
+			c.client.Close(false)
+		}
+	}()
+	c.client.SetLogger(log.New(logWriter{c.Logger}, "", 0))
 
-	if c.client.Caps["STARTTLS"] {
-		_, err = imap.Wait(c.client.StartTLS(nil))
-	}
+	if mode == TLS_STARTTLS {
+		if !c.client.Caps["STARTTLS"] {
+			return &ConfigError{fmt.Errorf("IMAP server does not support STARTTLS.")}
+		}
 
-	if err != nil {
-		return fmt.Errorf("Could not stablish TLS encrypted connection. ", err)
+		_, err = imap.Wait(c.client.StartTLS(config))
+		if err != nil {
+			return fmt.Errorf("Could not stablish TLS encrypted connection. %s", err)
+		}
 	}
 
 	if c.client.Caps["ID"] {
@@ -59,31 +197,289 @@ func (c *ImapClient) Connect() error {
 	}
 
 	c.client.SetLogMask(imap.LogConn)
-	_, err = imap.Wait(c.client.Login(c.Username, c.Password))
+	if c.TokenSource != nil {
+		err = c.oauthLogin()
+	} else {
+		err = c.login()
+	}
 	if err != nil {
-		return fmt.Errorf("IMAP authentication failed! Invalid credentials.")
+		return err
 	}
 	c.client.SetLogMask(imap.DefaultLogMask)
 
 	return err
 }
 
+// login authenticates with the preferred mechanism among Mechanism, or
+// MECHANISMS, that the server supports, falling back to the next ones when it
+// fails. EXTERNAL is only negotiated along with a client certificate, and
+// mechanisms unable to carry Identity are skipped when it is set.
+func (c *ImapClient) login() error {
+	mechanisms := MECHANISMS
+	if c.Mechanism != "" {
+		mechanisms = []string{strings.ToUpper(c.Mechanism)}
+	}
+
+	failures := []string{}
+	for _, mech := range mechanisms {
+		switch {
+		case mech == MECHANISM_LOGIN && c.client.Caps["LOGINDISABLED"]:
+			continue
+		case mech != MECHANISM_LOGIN && !c.client.Caps["AUTH="+mech]:
+			continue
+		case mech == MECHANISM_EXTERNAL && c.CertFile == "" && c.Mechanism == "":
+			continue
+		case (mech == MECHANISM_LOGIN || mech == MECHANISM_CRAM_MD5) && c.Identity != "":
+			continue
+		}
+
+		err := c.authenticate(mech)
+		if _, ok := err.(imap.NotAvailableError); ok {
+			// ie: PLAIN without TLS
+			continue
+		} else if err == nil {
+			return nil
+		}
+
+		if mech == MECHANISM_LOGIN {
+			err = fmt.Errorf("invalid credentials")
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", mech, err))
+		if c.Unavailable() != nil {
+			break
+		}
+	}
+
+	if len(failures) > 0 {
+		return c.configError(fmt.Errorf("IMAP authentication failed! %s", strings.Join(failures, "; ")))
+	}
+
+	offered := []string{}
+	for capability := range c.client.Caps {
+		if strings.HasPrefix(capability, "AUTH=") {
+			offered = append(offered, strings.TrimPrefix(capability, "AUTH="))
+		}
+	}
+	if !c.client.Caps["LOGINDISABLED"] {
+		offered = append(offered, MECHANISM_LOGIN)
+	}
+	sort.Strings(offered)
+
+	return &ConfigError{fmt.Errorf("IMAP server offers no usable authentication mechanism, only: %s", strings.Join(offered, ", "))}
+}
+
+func (c *ImapClient) authenticate(mech string) (err error) {
+	switch mech {
+	case MECHANISM_LOGIN:
+		_, err = imap.Wait(c.client.Login(c.Username, c.Password))
+	case MECHANISM_PLAIN:
+		_, err = c.client.Auth(imap.PlainAuth(c.Username, c.Password, c.Identity))
+	case MECHANISM_CRAM_MD5:
+		_, err = c.client.Auth(CramMD5(c.Username, c.Password))
+	case MECHANISM_SCRAM_SHA_1:
+		_, err = c.client.Auth(ScramSHA1(c.Username, c.Password, c.Identity))
+	case MECHANISM_SCRAM_SHA_256:
+		_, err = c.client.Auth(ScramSHA256(c.Username, c.Password, c.Identity))
+	case MECHANISM_EXTERNAL:
+		_, err = c.client.Auth(imap.ExternalAuth(c.Identity))
+	default:
+		err = fmt.Errorf("unknown mechanism")
+	}
+
+	return err
+}
+
+// oauthLogin authenticates with an access token of TokenSource, preferring
+// the standard OAUTHBEARER mechanism over XOAUTH2.
+func (c *ImapClient) oauthLogin() error {
+	token, err := c.TokenSource.Token()
+	if err != nil && tokenUnreachable(err) {
+		return fmt.Errorf("Could not get an OAuth2 access token: %s", err)
+	} else if err != nil {
+		return &ConfigError{fmt.Errorf("Could not get an OAuth2 access token: %s", err)}
+	}
+
+	var sasl imap.SASL
+	switch {
+	case c.client.Caps["AUTH=OAUTHBEARER"]:
+		sasl = OAuthBearer(c.Username, c.Host, c.Port, token.AccessToken)
+	case c.client.Caps["AUTH=XOAUTH2"]:
+		sasl = XOAuth2(c.Username, token.AccessToken)
+	default:
+		return &ConfigError{fmt.Errorf("IMAP server supports neither OAUTHBEARER nor XOAUTH2 authentication.")}
+	}
+
+	_, err = c.client.Auth(sasl)
+	if err != nil {
+		return c.configError(fmt.Errorf("IMAP OAuth2 authentication failed: %s", err))
+	}
+
+	return nil
+}
+
+// tokenUnreachable reports whether err, returned by a token source, is a
+// failure to reach the token endpoint, or an error of the endpoint itself,
+// rather than a missing or revoked token.
+func tokenUnreachable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil {
+		status := retrieveErr.Response.StatusCode
+		return status >= 500 || status == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
 func (c *ImapClient) Disconnect() {
 	imap.Wait(c.client.Logout(30 * time.Second))
 	c.client.Close(true)
 }
 
 func (c *ImapClient) Select(mailbox string) error {
-	_, err := imap.Wait(c.client.Select(mailbox, false))
+	_, err := c.wait(c.client.Select(mailbox, false))
 
 	if err != nil {
-		return fmt.Errorf("Failed to switch to mailbox %s", mailbox)
+		return c.configError(fmt.Errorf("Failed to switch to mailbox %s", mailbox))
 	}
 
 	return err
 }
 
-func (c *ImapClient) Unseen(chMsg chan string) (err error) {
+// Examine selects mailbox read-only, so that nothing in it changes.
+func (c *ImapClient) Examine(mailbox string) error {
+	_, err := c.wait(c.client.Select(mailbox, true))
+
+	if err != nil {
+		return fmt.Errorf("Failed to examine mailbox %s", mailbox)
+	}
+
+	return err
+}
+
+// UIDValidity returns the UIDVALIDITY of the selected mailbox: UIDs of a
+// mailbox are only meaningful as long as it does not change.
+func (c *ImapClient) UIDValidity() uint32 {
+	if c.client.Mailbox == nil {
+		return 0
+	}
+
+	return c.client.Mailbox.UIDValidity
+}
+
+// Since returns the UIDs of the messages of the selected mailbox received
+// since day, or of all of them when day is zero, in ascending order.
+func (c *ImapClient) Since(day time.Time) ([]uint32, error) {
+	criteria := []string{"ALL"}
+	if !day.IsZero() {
+		criteria = []string{"SINCE", day.Format("2-Jan-2006")}
+	}
+
+	uids, err := c.query(criteria...)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	return uids, nil
+}
+
+// Peek fetches the messages of uids, or only their header, without marking
+// them as seen. Messages are returned in ascending UID order.
+func (c *ImapClient) Peek(uids []uint32, headerOnly bool) ([]*Message, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	item, attr := "BODY.PEEK[]", "BODY[]"
+	if headerOnly {
+		item, attr = "BODY.PEEK[HEADER]", "BODY[HEADER]"
+	}
+
+	set, _ := imap.NewSeqSet("")
+	set.AddNum(uids...)
+
+	start := time.Now()
+	cmd, err := c.wait(c.client.UIDFetch(set, "UID", item))
+	if err != nil {
+		return nil, fmt.Errorf("An error ocurred while fetching messages data. %s", err)
+	}
+	end := time.Now()
+
+	messages := []*Message{}
+	for _, msg := range cmd.Data {
+		info := msg.MessageInfo()
+		if info == nil {
+			continue
+		}
+		messages = append(messages, &Message{
+			UID:        info.UID,
+			Raw:        imap.AsBytes(info.Attrs[attr]),
+			FetchStart: start,
+			FetchEnd:   end})
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].UID < messages[j].UID })
+
+	return messages, nil
+}
+
+// Capabilities returns the capabilities of the server, sorted.
+func (c *ImapClient) Capabilities() []string {
+	caps := []string{}
+	for capability := range c.client.Caps {
+		caps = append(caps, capability)
+	}
+	sort.Strings(caps)
+
+	return caps
+}
+
+// Mailboxes lists the mailboxes matching pattern, ie: "*" for all of them.
+func (c *ImapClient) Mailboxes(pattern string) ([]*Mailbox, error) {
+	cmd, err := c.wait(c.client.List("", imap.UTF7Encode(pattern)))
+	if err != nil {
+		return nil, fmt.Errorf("Could not list mailboxes. %s", err)
+	}
+
+	mailboxes := []*Mailbox{}
+	for _, resp := range cmd.Data {
+		info := resp.MailboxInfo()
+		if info == nil {
+			continue
+		}
+		mailbox := &Mailbox{Name: info.Name}
+		for flag := range info.Attrs {
+			mailbox.Flags = append(mailbox.Flags, flag)
+		}
+		sort.Strings(mailbox.Flags)
+		mailboxes = append(mailboxes, mailbox)
+	}
+
+	return mailboxes, nil
+}
+
+// Status sets the message counts of mailbox.
+func (c *ImapClient) Status(mailbox *Mailbox) error {
+	cmd, err := c.wait(c.client.Status(mailbox.Name, "MESSAGES", "UNSEEN"))
+	if err != nil {
+		return fmt.Errorf("Could not get the status of mailbox %s. %s", mailbox.Name, err)
+	}
+
+	for _, resp := range cmd.Data {
+		if status := resp.MailboxStatus(); status != nil {
+			mailbox.Messages = status.Messages
+			mailbox.Unseen = status.Unseen
+		}
+	}
+
+	return nil
+}
+
+func (c *ImapClient) Unseen(chMsg chan *Message) (err error) {
 	var ids []uint32
 
 	ids, err = c.query("UNSEEN")
@@ -108,85 +504,310 @@ func (c *ImapClient) Unseen(chMsg chan string) (err error) {
 			end = len(ids)
 		}
 		err = c.messagesForIds(ids[start:end], chMsg)
+		if err != nil {
+			return err
+		}
 	}
 
+	return err
+}
+
+// Fetch sends at most max unseen messages to chMsg, and returns how many were
+// sent and how many unseen messages are left on the server. As long as max
+// does not exceed the free capacity of chMsg, Fetch never blocks on it.
+func (c *ImapClient) Fetch(chMsg chan *Message, max int) (fetched int, remaining int, err error) {
+	var ids []uint32
+
+	ids, err = c.query("UNSEEN")
 	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(ids) > max {
+		remaining = len(ids) - max
+		ids = ids[:max]
+	}
+
+	err = c.messagesForIds(ids, chMsg)
+	if err != nil {
+		return 0, remaining, err
+	}
+
+	return len(ids), remaining, nil
+}
+
+func (c *ImapClient) Incoming(chMsg chan *Message) (err error) {
+	incoming, err := c.Idle(nil)
+	if err != nil || !incoming {
 		return err
 	}
 
-	return err
+	return c.Unseen(chMsg)
 }
 
-func (c *ImapClient) Incoming(chMsg chan string) (err error) {
-	err = c.waitForIncoming()
+// Idle waits for the server to notify mailbox changes, at most the IDLE
+// interval or until interrupt receives, and reports whether new messages may
+// have arrived.
+func (c *ImapClient) Idle(interrupt <-chan struct{}) (incoming bool, err error) {
+	err = c.waitForIncoming(interrupt)
 	if err != nil {
-		return err
+		return false, err
 	}
 
+	return c.changes(), nil
+}
+
+// SupportsIdle reports whether the server supports the IDLE command.
+func (c *ImapClient) SupportsIdle() bool {
+	return c.client.Caps["IDLE"]
+}
+
+// Poll waits interval, or until interrupt receives, then asks the server for
+// mailbox changes with NOOP: the fallback of Idle for servers without IDLE.
+// It reports whether new messages may have arrived.
+func (c *ImapClient) Poll(interrupt <-chan struct{}, interval time.Duration) (incoming bool, err error) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-interrupt:
+	}
+
+	_, err = c.wait(c.client.Noop())
+	if err != nil {
+		return false, fmt.Errorf("NOOP command failed. %s", err)
+	}
+
+	return c.changes(), nil
+}
+
+// idleInterval returns the interval after which IDLE commands are renewed.
+func (c *ImapClient) idleInterval() time.Duration {
+	if c.IdleInterval > 0 {
+		return c.IdleInterval
+	}
+
+	return IdleTimeout
+}
+
+// changes consumes the unilateral server data, and reports whether new
+// messages may have arrived.
+func (c *ImapClient) changes() (incoming bool) {
+	c.notice(c.client.Data)
+	incoming = c.changed()
+	c.client.Data = nil
+
+	return incoming
+}
+
+// changed reports whether the unilateral server data tells that new messages
+// may have arrived.
+func (c *ImapClient) changed() bool {
 	for _, resp := range c.client.Data {
 		switch resp.Label {
-		case "EXISTS":
-			return c.Unseen(chMsg)
-		case "FETCH":
-			return c.Unseen(chMsg)
+		case "EXISTS", "FETCH":
+			return true
 		}
-
 	}
 
+	return false
+}
+
+// Noop keeps the connection alive while not idling.
+func (c *ImapClient) Noop() error {
+	_, err := c.wait(c.client.Noop())
+	c.notice(c.client.Data)
+	c.client.Data = nil
+
 	return err
 }
 
+// ConfigError marks a failure which connecting again can not fix: invalid
+// credentials, TLS settings or mailbox.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+// IsConfigError reports whether err is a ConfigError.
+func IsConfigError(err error) bool {
+	_, ok := err.(*ConfigError)
+	return ok
+}
+
+// configError marks err, which the server answered to a command, as a
+// ConfigError unless the server is unavailable or the connection was lost.
+func (c *ImapClient) configError(err error) error {
+	if c.Unavailable() != nil {
+		return err
+	}
+
+	return &ConfigError{err}
+}
+
+// Unavailable returns why the connection can no longer be used: the server
+// closed it with BYE or dropped it, or answered with the UNAVAILABLE response
+// code (RFC 5530). It returns nil as long as the connection is usable.
+func (c *ImapClient) Unavailable() error {
+	if c.client == nil {
+		return fmt.Errorf("IMAP connection not established")
+	}
+
+	c.notice(c.client.Data)
+	if c.unavailable != "" {
+		return fmt.Errorf("IMAP server unavailable: %s", c.unavailable)
+	}
+
+	switch c.client.State() {
+	case imap.Logout, imap.Closed:
+		return fmt.Errorf("IMAP connection closed")
+	}
+
+	return nil
+}
+
+// notice records BYE and UNAVAILABLE responses, after which the server no
+// longer serves the connection.
+func (c *ImapClient) notice(responses []*imap.Response) {
+	for _, rsp := range responses {
+		if rsp.Status == imap.BYE || rsp.Label == "UNAVAILABLE" {
+			c.unavailable = rsp.Info
+			if c.unavailable == "" {
+				c.unavailable = rsp.Status.String()
+			}
+		}
+	}
+}
+
+// wait waits for the completion of cmd, as imap.Wait does, noticing whether
+// the server answered that it is unavailable.
+func (c *ImapClient) wait(cmd *imap.Command, err error) (*imap.Command, error) {
+	cmd, err = imap.Wait(cmd, err)
+	if rsp, ok := err.(imap.ResponseError); ok && rsp.Response != nil {
+		c.notice([]*imap.Response{rsp.Response})
+	}
+
+	return cmd, err
+}
+
 func (c *ImapClient) query(arguments ...string) ([]uint32, error) {
 	args := []imap.Field{}
 	for _, a := range arguments {
 		args = append(args, a)
 	}
 
-	cmd, err := imap.Wait(c.client.Search(args...))
+	cmd, err := c.wait(c.client.UIDSearch(args...))
 	if err != nil {
-		return nil, fmt.Errorf("An error ocurred while searching for messages. ", err)
+		return nil, fmt.Errorf("An error ocurred while searching for messages. %s", err)
 	}
 
 	return cmd.Data[0].SearchResults(), nil
 }
 
-func (c *ImapClient) messagesForIds(ids []uint32, chMsg chan string) error {
+func (c *ImapClient) messagesForIds(uids []uint32, chMsg chan *Message) error {
 
-	if len(ids) > 0 {
+	if len(uids) > 0 {
 		set, _ := imap.NewSeqSet("")
-		set.AddNum(ids...)
+		set.AddNum(uids...)
 
-		cmd, err := imap.Wait(c.client.Fetch(set, "RFC822"))
+		start := time.Now()
+		cmd, err := c.wait(c.client.UIDFetch(set, "UID", "RFC822"))
 		if err != nil {
-			return fmt.Errorf("An error ocurred while fetching unread messages data. ", err)
+			return fmt.Errorf("An error ocurred while fetching unread messages data. %s", err)
 		}
+		end := time.Now()
 
 		for _, msg := range cmd.Data {
-			attrs := msg.MessageInfo().Attrs
-			chMsg <- imap.AsString(attrs["RFC822"])
+			info := msg.MessageInfo()
+			chMsg <- &Message{
+				UID:        info.UID,
+				Raw:        imap.AsBytes(info.Attrs["RFC822"]),
+				FetchStart: start,
+				FetchEnd:   end}
 		}
 	}
 
 	return nil
 }
 
-func (c *ImapClient) waitForIncoming() (err error) {
+// waitForIncoming idles until the IDLE interval elapses, the server sends a
+// response or interrupt receives. With KeepAlive, the IDLE command is
+// interrupted by a NOOP command every KeepAlive.
+func (c *ImapClient) waitForIncoming(interrupt <-chan struct{}) error {
+	deadline := time.Now().Add(c.idleInterval())
+	for {
+		until := deadline
+		if c.KeepAlive > 0 && time.Now().Add(c.KeepAlive).Before(deadline) {
+			until = time.Now().Add(c.KeepAlive)
+		}
+
+		stopped, err := c.idle(interrupt, until)
+		if err != nil || stopped || !time.Now().Before(deadline) {
+			return err
+		}
+
+		_, err = c.wait(c.client.Noop())
+		if err != nil {
+			return fmt.Errorf("NOOP command failed. %s", err)
+		} else if c.changed() {
+			return nil
+		}
+	}
+}
+
+// idle runs an IDLE command until until, and reports whether it stopped
+// earlier, on a server response or as interrupt received.
+func (c *ImapClient) idle(interrupt <-chan struct{}, until time.Time) (stopped bool, err error) {
 	_, err = c.client.Idle()
 	if err != nil {
-		return fmt.Errorf("Could not start IDLE process. ", err)
+		return false, fmt.Errorf("Could not start IDLE process. %s", err)
 	}
 
-	err = c.client.Recv(IdleTimeout)
+	// responses are buffered by the client, so waiting in short steps loses
+	// none of them
+	for {
+		wait := until.Sub(time.Now())
+		if wait > idlePoll {
+			wait = idlePoll
+		} else if wait < 0 {
+			// a negative timeout blocks until the next response
+			wait = 0
+		}
+
+		err = c.client.Recv(wait)
+		if err != imap.ErrTimeout {
+			stopped = true
+			break
+		} else if interrupted(interrupt) {
+			stopped = true
+			break
+		} else if !time.Now().Before(until) {
+			break
+		}
+	}
 	if err != nil && err != imap.ErrTimeout {
-		return fmt.Errorf("Some error ocurred while IDLING: %q", err)
+		return true, fmt.Errorf("Some error ocurred while IDLING: %q", err)
 	}
 
-	_, err = imap.Wait(c.client.IdleTerm())
+	_, err = c.wait(c.client.IdleTerm())
 	if err != nil {
-		return fmt.Errorf("IDLE command termination failed for some reason. ", err)
+		return true, fmt.Errorf("IDLE command termination failed for some reason. %s", err)
 	}
 
-	return err
+	return stopped, nil
+}
+
+func interrupted(interrupt <-chan struct{}) bool {
+	select {
+	case <-interrupt:
+		return true
+	default:
+		return false
+	}
 }
 
 func init() {
@@ -194,11 +815,22 @@ func init() {
 	imap.DefaultLogMask = DefaultLogMask
 }
 
+func MechanismValid(mechanism string) bool {
+	for _, mech := range MECHANISMS {
+		if strings.EqualFold(mech, mechanism) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func NewClient(host string, port uint, ssl bool, username string, password string) *ImapClient {
 	return &ImapClient{
 		Host:     host,
 		Port:     port,
 		Ssl:      ssl,
 		Username: username,
-		Password: password}
+		Password: password,
+		Logger:   slog.Default()}
 }
@@ -0,0 +1,281 @@
+package imap
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+	"golang.org/x/oauth2"
+)
+
+// newTestClient connects a client to an IMAP server greeting it with
+// greeting, then answering its commands with serve.
+func newTestClient(t *testing.T, greeting string, serve func(c *textproto.Conn)) *ImapClient {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c := textproto.NewConn(conn)
+		defer c.Close()
+
+		c.PrintfLine("%s", greeting)
+		serve(c)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	c := NewClient("127.0.0.1", 143, false, "support@example.com", "secret")
+	c.Logger = slog.New(slog.DiscardHandler)
+	c.client, err = imap.NewClient(conn, "127.0.0.1", 5*time.Second)
+	if err != nil {
+		t.Fatalf("imap.NewClient() error = %v", err)
+	}
+	t.Cleanup(func() { c.client.Close(false) })
+
+	return c
+}
+
+// serveIdle answers an IDLE command, and its termination.
+func serveIdle(c *textproto.Conn) {
+	line, err := c.ReadLine()
+	if err != nil {
+		return
+	}
+	tag, _, _ := strings.Cut(line, " ")
+	c.PrintfLine("+ idling")
+
+	if line, err = c.ReadLine(); err != nil || line != "DONE" {
+		return
+	}
+	c.PrintfLine("%s OK IDLE terminated", tag)
+}
+
+// TestImapClientIdlePast checks that an IDLE command meant to end at a time
+// already past, ie: a KeepAlive shorter than the IDLE start up, ends at once.
+func TestImapClientIdlePast(t *testing.T) {
+	c := newTestClient(t, "* PREAUTH [CAPABILITY IMAP4rev1 IDLE] ready", serveIdle)
+
+	type result struct {
+		stopped bool
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		stopped, err := c.idle(nil, time.Now().Add(-time.Second))
+		done <- result{stopped, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil || r.stopped {
+			t.Errorf("idle() = %v, %v, want false, nil", r.stopped, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("idle() did not return")
+	}
+}
+
+// serveAuth answers AUTHENTICATE and LOGIN commands, accepting mechanism
+// accepted only, and reports the mechanisms tried on tried. With bye, the
+// server closes the connection after the first failure.
+func serveAuth(accepted string, bye bool, tried chan<- string) func(c *textproto.Conn) {
+	challenge := base64.StdEncoding.EncodeToString([]byte("<1896.697170952@postoffice.reston.mci.net>"))
+
+	return func(c *textproto.Conn) {
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+
+			fields := strings.Fields(line)
+			tag, verb, mech := fields[0], strings.ToUpper(fields[1]), MECHANISM_LOGIN
+			switch verb {
+			case "AUTHENTICATE":
+				mech = fields[2]
+				c.PrintfLine("+ %s", challenge)
+				if line, err = c.ReadLine(); err != nil {
+					return
+				} else if line == "*" {
+					c.PrintfLine("%s BAD Authentication cancelled", tag)
+					continue
+				}
+			case "LOGIN":
+			default:
+				c.PrintfLine("%s BAD Unexpected command", tag)
+				continue
+			}
+
+			tried <- mech
+			if mech == accepted {
+				c.PrintfLine("%s OK [CAPABILITY IMAP4rev1] Logged in", tag)
+			} else if bye {
+				c.PrintfLine("* BYE Authentication service unavailable")
+				return
+			} else {
+				c.PrintfLine("%s NO [AUTHENTICATIONFAILED] Authentication failed", tag)
+			}
+		}
+	}
+}
+
+func TestImapClientLogin(t *testing.T) {
+	tests := []struct {
+		name      string
+		mechanism string
+		accepted  string
+		bye       bool
+		tried     []string
+		wantErr   bool
+		config    bool
+	}{
+		{
+			name:     "preferred mechanism",
+			accepted: MECHANISM_SCRAM_SHA_256,
+			tried:    []string{MECHANISM_SCRAM_SHA_256},
+		},
+		{
+			name:     "fallback",
+			accepted: MECHANISM_CRAM_MD5,
+			tried:    []string{MECHANISM_SCRAM_SHA_256, MECHANISM_CRAM_MD5},
+		},
+		{
+			name:     "fallback to the LOGIN command",
+			accepted: MECHANISM_LOGIN,
+			tried:    []string{MECHANISM_SCRAM_SHA_256, MECHANISM_CRAM_MD5, MECHANISM_LOGIN},
+		},
+		{
+			name:    "invalid credentials",
+			tried:   []string{MECHANISM_SCRAM_SHA_256, MECHANISM_CRAM_MD5, MECHANISM_LOGIN},
+			wantErr: true,
+			config:  true,
+		},
+		{
+			name:      "configured mechanism",
+			mechanism: "cram-md5",
+			accepted:  MECHANISM_SCRAM_SHA_256,
+			tried:     []string{MECHANISM_CRAM_MD5},
+			wantErr:   true,
+			config:    true,
+		},
+		{
+			name:    "server unavailable",
+			bye:     true,
+			tried:   []string{MECHANISM_SCRAM_SHA_256},
+			wantErr: true,
+			config:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tried := make(chan string, 10)
+			c := newTestClient(t, "* OK [CAPABILITY IMAP4rev1 AUTH=SCRAM-SHA-256 AUTH=CRAM-MD5] ready", serveAuth(tt.accepted, tt.bye, tried))
+			c.Mechanism = tt.mechanism
+
+			err := c.login()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("login() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && IsConfigError(err) != tt.config {
+				t.Errorf("IsConfigError(%v) = %v, want %v", err, IsConfigError(err), tt.config)
+			}
+
+			got := []string{}
+			for len(got) < len(tt.tried) {
+				select {
+				case mech := <-tried:
+					got = append(got, mech)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("tried %v, want %v", got, tt.tried)
+				}
+			}
+			select {
+			case mech := <-tried:
+				t.Errorf("tried %v and %s, want %v", got, mech, tt.tried)
+			default:
+			}
+			if strings.Join(got, " ") != strings.Join(tt.tried, " ") {
+				t.Errorf("tried %v, want %v", got, tt.tried)
+			}
+		})
+	}
+}
+
+// errorTokenSource fails to return a token with err.
+type errorTokenSource struct {
+	err error
+}
+
+func (s errorTokenSource) Token() (*oauth2.Token, error) {
+	return nil, s.err
+}
+
+func TestImapClientOAuthTokenErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		config bool
+	}{
+		{
+			name:   "no token file",
+			err:    &os.PathError{Op: "open", Path: "token.json", Err: os.ErrNotExist},
+			config: true,
+		},
+		{
+			name:   "revoked token",
+			err:    &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}, ErrorCode: "invalid_grant"},
+			config: true,
+		},
+		{
+			name:   "token endpoint unavailable",
+			err:    &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}},
+			config: false,
+		},
+		{
+			name:   "token endpoint throttling",
+			err:    &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusTooManyRequests}},
+			config: false,
+		},
+		{
+			name:   "token endpoint unreachable",
+			err:    &url.Error{Op: "Post", URL: "https://oauth2.example.com/token", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}},
+			config: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient("imap.example.com", 993, true, "support@example.com", "")
+			c.TokenSource = errorTokenSource{tt.err}
+
+			err := c.oauthLogin()
+			if err == nil {
+				t.Fatalf("oauthLogin() succeeded")
+			}
+			if IsConfigError(err) != tt.config {
+				t.Errorf("IsConfigError(%v) = %v, want %v", err, IsConfigError(err), tt.config)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package imap
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// cramMD5Auth implements the CRAM-MD5 SASL mechanism of RFC 2195.
+type cramMD5Auth struct {
+	username string
+	password string
+}
+
+func (a *cramMD5Auth) Start(s *imap.ServerInfo) (mech string, ir []byte, err error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (a *cramMD5Auth) Next(challenge []byte) (response []byte, err error) {
+	mac := hmac.New(md5.New, []byte(a.password))
+	mac.Write(challenge)
+
+	return []byte(a.username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// CramMD5 returns the CRAM-MD5 mechanism.
+func CramMD5(username string, password string) imap.SASL {
+	return &cramMD5Auth{username: username, password: password}
+}
+
+// scramAuth implements the SCRAM SASL mechanisms of RFC 5802 and RFC 7677,
+// without channel binding. The password is not SASLprep normalized.
+type scramAuth struct {
+	mech     string
+	hash     func() hash.Hash
+	username string
+	password string
+	identity string
+
+	step            int
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func (a *scramAuth) Start(s *imap.ServerInfo) (mech string, ir []byte, err error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	a.nonce = base64.StdEncoding.EncodeToString(nonce)
+	a.clientFirstBare = "n=" + saslName(a.username) + ",r=" + a.nonce
+	a.step = 0
+
+	return a.mech, []byte(a.gs2Header() + a.clientFirstBare), nil
+}
+
+func (a *scramAuth) Next(challenge []byte) (response []byte, err error) {
+	attrs := scramAttributes(string(challenge))
+	if e, ok := attrs["e"]; ok {
+		return nil, fmt.Errorf("%s authentication failed: %s", a.mech, e)
+	}
+
+	a.step++
+	switch a.step {
+	case 1:
+		return a.clientFinal(string(challenge), attrs)
+	case 2:
+		signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil || !hmac.Equal(signature, a.serverSignature) {
+			return nil, fmt.Errorf("%s server signature mismatch", a.mech)
+		}
+		return []byte{}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %s server challenge", a.mech)
+}
+
+// clientFinal answers the server first message with the client proof.
+func (a *scramAuth) clientFinal(serverFirst string, attrs map[string]string) ([]byte, error) {
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, a.nonce) {
+		return nil, fmt.Errorf("%s server nonce mismatch", a.mech)
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s salt: %s", a.mech, err)
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("invalid %s iteration count: %s", a.mech, attrs["i"])
+	}
+
+	salted, err := pbkdf2.Key(a.hash, a.password, salt, iterations, a.hash().Size())
+	if err != nil {
+		return nil, err
+	}
+
+	clientKey := a.hmac(salted, "Client Key")
+	storedKey := a.hash()
+	storedKey.Write(clientKey)
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(a.gs2Header())) + ",r=" + nonce
+	authMessage := a.clientFirstBare + "," + serverFirst + "," + withoutProof
+
+	proof := a.hmac(storedKey.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	a.serverSignature = a.hmac(a.hmac(salted, "Server Key"), authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (a *scramAuth) gs2Header() string {
+	if a.identity == "" {
+		return "n,,"
+	}
+
+	return "n,a=" + saslName(a.identity) + ","
+}
+
+func (a *scramAuth) hmac(key []byte, message string) []byte {
+	mac := hmac.New(a.hash, key)
+	mac.Write([]byte(message))
+
+	return mac.Sum(nil)
+}
+
+// scramAttributes parses the comma separated name=value attributes of a
+// SCRAM message.
+func scramAttributes(message string) map[string]string {
+	attrs := map[string]string{}
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) > 1 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+
+	return attrs
+}
+
+// ScramSHA256 returns the SCRAM-SHA-256 mechanism. A non empty identity is
+// the user to act as, once authenticated as username.
+func ScramSHA256(username string, password string, identity string) imap.SASL {
+	return &scramAuth{mech: "SCRAM-SHA-256", hash: sha256.New, username: username, password: password, identity: identity}
+}
+
+// ScramSHA1 returns the SCRAM-SHA-1 mechanism. A non empty identity is the
+// user to act as, once authenticated as username.
+func ScramSHA1(username string, password string, identity string) imap.SASL {
+	return &scramAuth{mech: "SCRAM-SHA-1", hash: sha1.New, username: username, password: password, identity: identity}
+}
+
+// xoauth2Auth implements the XOAUTH2 SASL mechanism of Gmail and Microsoft
+// 365.
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Auth) Start(s *imap.ServerInfo) (mech string, ir []byte, err error) {
+	if !s.TLS {
+		return "", nil, imap.NotAvailableError("AUTH=XOAUTH2")
+	}
+
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next receives the error status of a failed authentication, as a json
+// document.
+func (a *xoauth2Auth) Next(challenge []byte) (response []byte, err error) {
+	return nil, fmt.Errorf("XOAUTH2 authentication failed: %s", challenge)
+}
+
+// XOAuth2 returns the XOAUTH2 mechanism, authenticating username with an
+// OAuth2 access token.
+func XOAuth2(username string, token string) imap.SASL {
+	return &xoauth2Auth{username: username, token: token}
+}
+
+// oauthBearerAuth implements the OAUTHBEARER SASL mechanism of RFC 7628.
+type oauthBearerAuth struct {
+	username string
+	host     string
+	port     uint
+	token    string
+}
+
+func (a *oauthBearerAuth) Start(s *imap.ServerInfo) (mech string, ir []byte, err error) {
+	if !s.TLS {
+		return "", nil, imap.NotAvailableError("AUTH=OAUTHBEARER")
+	}
+
+	ir = []byte(fmt.Sprintf("n,a=%s,\x01host=%s\x01port=%d\x01auth=Bearer %s\x01\x01", saslName(a.username), a.host, a.port, a.token))
+
+	return "OAUTHBEARER", ir, nil
+}
+
+// Next receives the error status of a failed authentication, as a json
+// document.
+func (a *oauthBearerAuth) Next(challenge []byte) (response []byte, err error) {
+	return nil, fmt.Errorf("OAUTHBEARER authentication failed: %s", challenge)
+}
+
+// OAuthBearer returns the OAUTHBEARER mechanism, authenticating username on
+// host:port with an OAuth2 access token.
+func OAuthBearer(username string, host string, port uint, token string) imap.SASL {
+	return &oauthBearerAuth{username: username, host: host, port: port, token: token}
+}
+
+// saslName escapes the "," and "=" characters of a GS2 authorization
+// identity.
+func saslName(name string) string {
+	escaped := ""
+	for _, r := range name {
+		switch r {
+		case ',':
+			escaped += "=2C"
+		case '=':
+			escaped += "=3D"
+		default:
+			escaped += string(r)
+		}
+	}
+
+	return escaped
+}
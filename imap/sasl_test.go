@@ -0,0 +1,169 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// TestCramMD5 checks the example exchange of RFC 2195.
+func TestCramMD5(t *testing.T) {
+	sasl := CramMD5("tim", "tanstaaftanstaaf")
+
+	mech, ir, err := sasl.Start(&imap.ServerInfo{})
+	if mech != "CRAM-MD5" || ir != nil || err != nil {
+		t.Fatalf("Start() = %q, %q, %v", mech, ir, err)
+	}
+
+	response, err := sasl.Next([]byte("<1896.697170952@postoffice.reston.mci.net>"))
+	if want := "tim b913a602c7eda7a495b4e6e7334d3890"; string(response) != want || err != nil {
+		t.Errorf("Next() = %q, %v, want %q", response, err, want)
+	}
+}
+
+// TestScram checks the example exchanges of RFC 5802 (SCRAM-SHA-1) and
+// RFC 7677 (SCRAM-SHA-256).
+func TestScram(t *testing.T) {
+	tests := []struct {
+		sasl        imap.SASL
+		mech        string
+		nonce       string
+		serverFirst string
+		clientFinal string
+		serverFinal string
+	}{
+		{
+			sasl:        ScramSHA1("user", "pencil", ""),
+			mech:        "SCRAM-SHA-1",
+			nonce:       "fyko+d2lbbFgONRv9qkxdawL",
+			serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		},
+		{
+			sasl:        ScramSHA256("user", "pencil", ""),
+			mech:        "SCRAM-SHA-256",
+			nonce:       "rOprNGfwEbeRWgbNEkqO",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mech, func(t *testing.T) {
+			mech, ir, err := tt.sasl.Start(&imap.ServerInfo{})
+			if err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			a := tt.sasl.(*scramAuth)
+			if want := "n,,n=user,r=" + a.nonce; mech != tt.mech || string(ir) != want {
+				t.Errorf("Start() = %q, %q, want %q, %q", mech, ir, tt.mech, want)
+			}
+
+			// the nonce of the examples, instead of the random one
+			a.nonce = tt.nonce
+			a.clientFirstBare = "n=user,r=" + tt.nonce
+
+			response, err := tt.sasl.Next([]byte(tt.serverFirst))
+			if string(response) != tt.clientFinal || err != nil {
+				t.Fatalf("Next(server-first) = %q, %v, want %q", response, err, tt.clientFinal)
+			}
+
+			response, err = tt.sasl.Next([]byte(tt.serverFinal))
+			if len(response) != 0 || err != nil {
+				t.Errorf("Next(server-final) = %q, %v, want an empty response", response, err)
+			}
+		})
+	}
+}
+
+func TestScramFailures(t *testing.T) {
+	const (
+		nonce       = "fyko+d2lbbFgONRv9qkxdawL"
+		serverFirst = "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"
+	)
+
+	tests := []struct {
+		name        string
+		serverFirst string
+		serverFinal string
+	}{
+		{name: "server error", serverFirst: "e=unknown-user"},
+		{name: "nonce mismatch", serverFirst: "r=3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"},
+		{name: "invalid salt", serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=!,i=4096"},
+		{name: "invalid iteration count", serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=0"},
+		{name: "signature mismatch", serverFirst: serverFirst, serverFinal: "v=AAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+		{name: "final server error", serverFirst: serverFirst, serverFinal: "e=invalid-proof"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sasl := ScramSHA1("user", "pencil", "")
+			sasl.Start(&imap.ServerInfo{})
+			a := sasl.(*scramAuth)
+			a.nonce = nonce
+			a.clientFirstBare = "n=user,r=" + nonce
+
+			_, err := sasl.Next([]byte(tt.serverFirst))
+			if tt.serverFinal == "" {
+				if err == nil {
+					t.Errorf("Next(%q) succeeded", tt.serverFirst)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Next(%q) error = %v", tt.serverFirst, err)
+			}
+			if _, err = sasl.Next([]byte(tt.serverFinal)); err == nil {
+				t.Errorf("Next(%q) succeeded", tt.serverFinal)
+			}
+		})
+	}
+}
+
+func TestScramIdentity(t *testing.T) {
+	mech, ir, err := ScramSHA256("user", "pencil", "shared,box=1").Start(&imap.ServerInfo{})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if want := "n,a=shared=2Cbox=3D1,n=user,r="; mech != "SCRAM-SHA-256" || string(ir[:len(want)]) != want {
+		t.Errorf("Start() = %q, %q, want the GS2 header %q", mech, ir, want)
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	tests := []struct {
+		sasl imap.SASL
+		mech string
+		ir   string
+	}{
+		{
+			sasl: XOAuth2("user@example.com", "token"),
+			mech: "XOAUTH2",
+			ir:   "user=user@example.com\x01auth=Bearer token\x01\x01",
+		},
+		{
+			sasl: OAuthBearer("user,1@example.com", "imap.example.com", 993, "token"),
+			mech: "OAUTHBEARER",
+			ir:   "n,a=user=2C1@example.com,\x01host=imap.example.com\x01port=993\x01auth=Bearer token\x01\x01",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mech, func(t *testing.T) {
+			if _, _, err := tt.sasl.Start(&imap.ServerInfo{}); err == nil {
+				t.Errorf("Start() without TLS succeeded")
+			}
+
+			mech, ir, err := tt.sasl.Start(&imap.ServerInfo{TLS: true})
+			if mech != tt.mech || string(ir) != tt.ir || err != nil {
+				t.Errorf("Start() = %q, %q, %v, want %q, %q", mech, ir, err, tt.mech, tt.ir)
+			}
+
+			if _, err := tt.sasl.Next([]byte(`{"status":"401"}`)); err == nil {
+				t.Errorf("Next() with an error status succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package imap
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+const (
+	// TLS from the start of the connection, usually on port 993
+	TLS_IMPLICIT = "implicit"
+	// plaintext connection upgraded with STARTTLS, which must succeed
+	TLS_STARTTLS = "starttls"
+	// no encryption, only to the local host
+	TLS_PLAINTEXT = "plaintext"
+
+	DEFAULT_TLS_MIN_VERSION = tls.VersionTLS12
+
+	pinPrefix = "sha256/"
+)
+
+var (
+	TLS_MODES = map[string]bool{
+		TLS_IMPLICIT:  true,
+		TLS_STARTTLS:  true,
+		TLS_PLAINTEXT: true}
+
+	TLS_VERSIONS = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13}
+)
+
+// tlsMode returns TLSMode, or else implicit TLS on port 993 or with Ssl, and
+// required STARTTLS otherwise.
+func (c *ImapClient) tlsMode() string {
+	if c.TLSMode != "" {
+		return c.TLSMode
+	}
+	if c.Port == 993 || c.Ssl {
+		return TLS_IMPLICIT
+	}
+
+	return TLS_STARTTLS
+}
+
+// tlsConfig returns the TLS configuration of the connection.
+func (c *ImapClient) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: c.MinVersion}
+
+	if config.MinVersion == 0 {
+		config.MinVersion = DEFAULT_TLS_MIN_VERSION
+	}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA file: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in CA file %s", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load TLS client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(c.Pins) > 0 {
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPins(state.PeerCertificates, c.Pins)
+		}
+	}
+
+	return config, nil
+}
+
+// verifyPins checks that the public key of one of the certificates of the
+// server, its own or an issuer's, is pinned.
+func verifyPins(certs []*x509.Certificate, pins []string) error {
+	for _, cert := range certs {
+		pin := PublicKeyPin(cert)
+		for _, p := range pins {
+			if strings.TrimPrefix(p, pinPrefix) == strings.TrimPrefix(pin, pinPrefix) {
+				return nil
+			}
+		}
+	}
+
+	if len(certs) == 0 {
+		return fmt.Errorf("no server certificate")
+	}
+
+	return fmt.Errorf("server certificate public key %s is not pinned", PublicKeyPin(certs[0]))
+}
+
+// PublicKeyPin returns the pin of the public key of cert: sha256/ followed by
+// the base64 sha256 digest of its DER encoded SubjectPublicKeyInfo, as in
+// HPKP or curl --pinnedpubkey.
+func PublicKeyPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return pinPrefix + base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// PinValid reports whether pin is a base64 sha256 digest, prefixed or not
+// with sha256/.
+func PinValid(pin string) bool {
+	digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+
+	return err == nil && len(digest) == sha256.Size
+}
+
+// IsLocalhost reports whether host is the local host, the only one reached
+// without TLS.
+func IsLocalhost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func TLSModeValid(mode string) bool {
+	return TLS_MODES[mode]
+}
+
+// TLSVersion returns the TLS version numbered version, ie: "1.2".
+func TLSVersion(version string) (uint16, bool) {
+	v, ok := TLS_VERSIONS[version]
+
+	return v, ok
+}
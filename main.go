@@ -1,50 +1,42 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/signal"
 	"runtime"
 	"strings"
 	"syscall"
-
+	"time"
+
+	"github.com/etrepat/postman/handler"
+	"github.com/etrepat/postman/imap"
+	"github.com/etrepat/postman/oauth"
+	"github.com/etrepat/postman/redact"
+	"github.com/etrepat/postman/secret"
+	"github.com/etrepat/postman/server"
+	"github.com/etrepat/postman/tracing"
 	"github.com/etrepat/postman/version"
 	"github.com/etrepat/postman/watch"
-	"github.com/kelseyhightower/envconfig"
 	flag "github.com/ogier/pflag"
 )
 
-// Specification of config values located as ENV variables
-// They have name POSTMAN_*
-type Specification struct {
-	Debug     bool
-	Email     string
-	Password  string
-	RoomAuth  string
-	RoomColor string
-	RoomName  string
-	Mode      string
-	SSL       bool
-	Host      string
-}
-
-//Health respond to http requests for health checks
-type Health struct{}
-
-var connection string
-
-func (h Health) ServeHTTP(
-	w http.ResponseWriter,
-	r *http.Request) {
-	fmt.Fprintf(w, "Service responding from %s", r.URL.Path[1:])
-}
+// exit status of --once runs
+const (
+	EXIT_OK          = 0
+	EXIT_UNAVAILABLE = 1
+	EXIT_UNDELIVERED = 3
+)
 
-func handleHealth() {
+// logLevel is the level of the logger, changed on reload.
+var logLevel = new(slog.LevelVar)
 
-	var h Health
-	err := http.ListenAndServe(connection, h)
+func handleHealth(srv *server.Server) {
+	err := srv.ListenAndServe()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -53,141 +45,390 @@ func handleHealth() {
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	wFlags, err := parseAndCheckFlags()
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		printMessageAndExit("%s", err)
+	}
+
+	if command := strings.Join(cfg.args, " "); command != "" && command != "run" {
+		status, err := runCommand(cfg, command)
+		if err != nil {
+			printMessageAndExit("%s", err)
+		} else if status != EXIT_OK {
+			os.Exit(status)
+		}
+		return
+	}
+
+	err = cfg.check()
 	if err != nil {
-		printMessageAndExit(err.Error())
+		printMessageAndExit("%s", err)
 	}
 
-	watch := watch.New(wFlags)
+	err = setupLogger(cfg)
+	if err != nil {
+		printMessageAndExit("%s", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.otlpEndpoint, cfg.otlpInsecure)
+	if err != nil {
+		printMessageAndExit("%s: could not set up tracing: %s\n", version.App(), err)
+	}
+
+	watch, err := watch.New(cfg.watch)
+	if err != nil {
+		printMessageAndExit("%s: %s\n", version.App(), err)
+	}
+
+	status := EXIT_OK
+	if cfg.once {
+		status = runOnce(watch)
+	} else {
+		serve(cfg, watch)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("could not flush traces", "error", err)
+	}
+
+	if status != EXIT_OK {
+		cancel()
+		os.Exit(status)
+	}
+
+	fmt.Println("Have a nice day.")
+}
+
+// serve watches the mailbox and serves the http endpoints until SIGINT or
+// SIGTERM.
+func serve(cfg *config, watch *watch.Watch) {
 	go watch.Start()
 
-	//In case hosting docker container that pings a health endpoint
-	go handleHealth()
+	//In case hosting docker container that pings a health endpoint, along
+	//with readiness checks and prometheus metrics
+	srv := server.New(cfg.listen, watch)
+	srv.IdleCycles = cfg.readyIdleCycles
+	srv.AdminToken = cfg.adminToken
+	go handleHealth(srv)
 
 	// When CTRL+C, SIGINT and SIGTERM signal occurs
-	// Then Close IMAP connection
-	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	<-ch
-	close(ch)
+	// Then Close IMAP connection. SIGHUP reloads the configuration.
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range ch {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		cfg = reloadConfig(cfg, watch)
+	}
+	signal.Stop(ch)
 	watch.Stop()
+}
 
-	fmt.Println("Have a nice day.")
+// runOnce delivers the unseen messages of the mailbox and returns the exit
+// status: EXIT_UNAVAILABLE when the IMAP server failed, EXIT_UNDELIVERED when
+// some messages could not be delivered.
+func runOnce(watch *watch.Watch) int {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(ch)
+	go func() {
+		<-ch
+		watch.Stop()
+	}()
+
+	err := watch.RunOnce()
+	watch.Close()
+	if err != nil {
+		slog.Error("watch failed", "error", err)
+		return EXIT_UNAVAILABLE
+	}
+
+	if failed := len(watch.DeadLetters()); failed > 0 {
+		slog.Error("some messages could not be delivered", "count", failed)
+		return EXIT_UNDELIVERED
+	}
+
+	return EXIT_OK
 }
 
-func parseAndCheckFlags() (*watch.Flags, error) {
-	wflags := watch.NewFlags()
-	printVersion := false
-
-	flag.Usage = printUsage
-
-	flag.StringVarP(&wflags.Host, "host", "h", "imap.gmail.com", "IMAP server hostname or ip address.")
-	flag.UintVarP(&wflags.Port, "port", "p", 993, "IMAP server port number. Defaults to 143 or 993 for ssl.")
-	flag.BoolVar(&wflags.Ssl, "ssl", true, "Enforce a SSL connection. Defaults to true if port is 993.")
-	flag.StringVarP(&wflags.Username, "user", "U", "", "IMAP login username.")
-	flag.StringVarP(&wflags.Password, "password", "P", "", "IMAP login password.")
-	flag.StringVarP(&wflags.Mailbox, "mailbox", "b", "INBOX", "Mailbox to monitor/idle on. Defaults to: \"INBOX\".")
-	flag.StringVarP(&wflags.Mode, "mode", "m", "", fmt.Sprintf("Mode of delivery. Valid delivery modes are: %s.", strings.Join(watch.ValidDeliveryModes(), ", ")))
-	flag.StringVar(&wflags.PostbackUrl, "postback-url", "", "(postback only) URL to post incoming raw email message data.")
-	flag.BoolVar(&wflags.PostEncoded, "encode", false, "(postback only) POST messages as form data (x-form-urlencoded). See `parname` flag.")
-	flag.StringVar(&wflags.PostParamName, "parname", "message", "(postback only) POST parameter name. Defaults to: \"message\".")
-	flag.BoolVarP(&printVersion, "version", "v", false, "Outputs the version information.")
-	flag.StringVarP(&wflags.RoomAuth, "auth", "a", "", "(hipchat only) room authentication token.")
-	flag.StringVarP(&wflags.RoomName, "name", "n", "", "(hipchat only) room name.")
-	flag.StringVarP(&wflags.RoomColor, "color", "c", "green", "(hipchat only) room color. Defaults to \"green\".")
-
-	flag.Parse()
-
-	//Going to use environment variables instead and populate the wflags structure
-	//This is good for docker usage that doesn't execute a shell
-	if flag.NFlag() == 0 {
-
-		var s Specification
-
-		//Set defaults, gets overridden by environment variables
-		s.Debug = true
-		s.RoomAuth = ""
-		s.RoomName = ""
-		s.RoomColor = "random"
-		s.Host = "imap.gmail.com"
-		s.SSL = true
-		s.Email = ""
-		s.Password = ""
-		s.Mode = "hipchat"
-
-		//PORT0 can't have HIPCHAT_PORT0, so checking for it's env seperately
-		port := os.Getenv("PORT0")
-
-		if len(port) < 1 {
-			port = "4000"
-		}
+// reloadConfig loads the configuration again and applies it to the delivery
+// chain and the log level, without dropping the IMAP connection. An invalid
+// configuration is logged and ignored.
+func reloadConfig(current *config, w *watch.Watch) *config {
+	cfg, err := loadConfig(os.Args[1:])
+	if err == nil {
+		err = cfg.check()
+	}
+	if err != nil {
+		slog.Error("configuration not reloaded", "error", strings.TrimSpace(err.Error()))
+		return current
+	}
 
-		connection = fmt.Sprintf("0.0.0.0:%s", port)
+	if err := w.Reload(cfg.watch); err != nil {
+		slog.Error("configuration not reloaded", "error", err)
+		return current
+	}
 
-		fmt.Printf("Connection: %s\n", connection)
+	level, _ := parseLogLevel(cfg.logLevel)
+	logLevel.Set(level)
 
-		//This merges environment variables and defaults
-		err := envconfig.Process("postman", &s)
-		if err != nil {
-			log.Fatal(err.Error())
+	slog.Info("configuration reloaded", "file", cfg.file)
+	if changed := current.restartChanges(cfg); len(changed) > 0 {
+		slog.Warn("options only applied on restart", "options", strings.Join(changed, ","))
+	}
+
+	return cfg
+}
+
+func checkFlags(wflags *watch.Flags) error {
+	if err := checkConnectionFlags(wflags); err != nil {
+		return err
+	}
+
+	if wflags.Mode == "" {
+		return newFlagsError("Delivery mode must be specified. Should be one of: %s.", strings.Join(watch.ValidDeliveryModes(), ", "))
+	}
+
+	for _, mode := range wflags.Modes() {
+		if !watch.DeliveryModeValid(mode) {
+			return newFlagsError("Unknown delivery mode: \"%s\". Must be one of: %s.", mode, strings.Join(watch.ValidDeliveryModes(), ", "))
 		}
+	}
 
-		//Add to wflags to perform rest of validation and use in app
-		wflags.RoomAuth = s.RoomAuth
-		wflags.RoomName = s.RoomName
-		wflags.RoomColor = s.RoomColor
-		wflags.Host = s.Host
-		wflags.Ssl = s.SSL
-		wflags.Username = s.Email
-		wflags.Password = s.Password
-		wflags.Mode = s.Mode
+	if wflags.HasMode("postback") && wflags.PostbackUrl == "" {
+		return newFlagsError("On postback mode, delivery url must be specified.")
+	} else if wflags.HasMode("hipchat") && wflags.RoomAuth == "" {
+		return newFlagsError("On hipchat mode, room authentication token must be specified.")
+	} else if wflags.HasMode("hipchat") && wflags.RoomName == "" {
+		return newFlagsError("On hipchat mode, room name must be specified.")
+	} else if wflags.HasMode("hipchat") && !handler.HipChatFormatValid(wflags.RoomFormat) {
+		return newFlagsError("Unknown hipchat format: \"%s\". Must be one of: text, html.", wflags.RoomFormat)
+	} else if wflags.HasMode("forward") && wflags.SmtpHost == "" {
+		return newFlagsError("On forward mode, SMTP server host must be specified.")
+	} else if wflags.HasMode("forward") && len(wflags.ForwardTo) == 0 {
+		return newFlagsError("On forward mode, at least one recipient must be specified.")
+	} else if wflags.HasMode("forward") && !handler.ForwardStyleValid(wflags.ForwardStyle) {
+		return newFlagsError("Unknown forward style: \"%s\". Must be one of: inline, attach, redirect.", wflags.ForwardStyle)
+	} else if wflags.HasMode("forward") && wflags.SmtpTlsMode != "" && !imap.TLSModeValid(wflags.SmtpTlsMode) {
+		return newFlagsError("Unknown SMTP TLS mode: \"%s\". Must be one of: implicit, starttls, plaintext.", wflags.SmtpTlsMode)
+	} else if wflags.HasMode("forward") && wflags.SmtpTlsMode == imap.TLS_PLAINTEXT && !imap.IsLocalhost(wflags.SmtpHost) {
+		return newFlagsError("Plaintext SMTP connections are only allowed to localhost.")
+	} else if wflags.HasMode("archive") && wflags.ArchivePath == "" {
+		return newFlagsError("On archive mode, archive path must be specified.")
+	} else if wflags.HasMode("archive") && !handler.ArchiveFormatValid(wflags.ArchiveFormat) {
+		return newFlagsError("Unknown archive format: \"%s\". Must be one of: maildir, mbox.", wflags.ArchiveFormat)
+	} else if wflags.HasMode("archive") && !handler.ArchiveRotationValid(wflags.ArchiveRotate) {
+		return newFlagsError("Unknown archive rotation: \"%s\". Must be one of: none, daily, monthly.", wflags.ArchiveRotate)
+	} else if wflags.HasMode("exec") && wflags.ExecCommand == "" {
+		return newFlagsError("On exec mode, command must be specified.")
+	} else if hasQueueMode(wflags) && wflags.QueueUrl == "" {
+		return newFlagsError("On amqp, nats and kafka modes, broker url must be specified.")
+	} else if wflags.HasMode("kafka") && wflags.QueueTopic == "" {
+		return newFlagsError("On kafka mode, topic must be specified.")
+	} else if hasQueueMode(wflags) && !handler.QueueFormatValid(wflags.QueueFormat) {
+		return newFlagsError("Unknown queue format: \"%s\". Must be one of: raw, json.", wflags.QueueFormat)
+	} else if wflags.HasMode("s3") && wflags.S3Bucket == "" {
+		return newFlagsError("On s3 mode, bucket must be specified.")
+	}
 
-		fmt.Println("Initialized values from Environment Variables")
-		fmt.Printf("Host: %s\nSSL: %t\nUsername: %s\nPassword: %s\nMode: %s\nRoomAuth: %s\nRoomName: %s\nRoomColor: %s\n", wflags.Host, wflags.Ssl, wflags.Username, wflags.Password, wflags.Mode, wflags.RoomAuth, wflags.RoomName, wflags.RoomColor)
+	if !watch.OrderValid(wflags.Order) {
+		return newFlagsError("Unknown order: \"%s\". Must be one of: none, sender, thread.", wflags.Order)
 	}
 
-	if printVersion {
-		return wflags, newError("%s\n", version.Version())
+	if wflags.PollInterval <= 0 {
+		return newFlagsError("Poll interval must be positive.")
 	}
 
+	if wflags.IdleInterval <= 0 || wflags.IdleInterval > imap.MaxIdleInterval {
+		return newFlagsError("IDLE interval must be positive and at most %s.", imap.MaxIdleInterval)
+	}
+
+	if wflags.KeepAlive < 0 {
+		return newFlagsError("Keepalive interval must not be negative.")
+	}
+
+	if wflags.HasMode("forward") && wflags.ForwardFrom == "" {
+		wflags.ForwardFrom = wflags.Username
+	}
+
+	return nil
+}
+
+// checkConnectionFlags checks the options of the IMAP connection, needed by
+// every command.
+func checkConnectionFlags(wflags *watch.Flags) error {
 	if wflags.Host == "" {
-		return wflags, newFlagsError("IMAP server host is mandatory.")
+		return newFlagsError("IMAP server host is mandatory.")
 	}
 
-	if wflags.Mode == "" {
-		return wflags, newFlagsError("Delivery mode must be specified. Should be one of: %s.", strings.Join(watch.ValidDeliveryModes(), ", "))
+	if wflags.PasswordFile != "" {
+		if _, err := secret.File(wflags.PasswordFile).Secret(); err != nil {
+			return newFlagsError("Invalid password file: %s.", err)
+		}
+	}
+
+	if err := checkTLSFlags(wflags); err != nil {
+		return err
+	}
+
+	if err := checkAuthFlags(wflags); err != nil {
+		return err
+	}
+
+	return checkOAuthFlags(wflags)
+}
+
+// checkTLSFlags checks the TLS options, and settles the TLS mode and port:
+// implicit TLS on port 993, STARTTLS or plaintext on port 143.
+func checkTLSFlags(wflags *watch.Flags) error {
+	if wflags.TlsMode == "" {
+		wflags.TlsMode = imap.TLS_IMPLICIT
+		if !wflags.Ssl && wflags.Port != 993 {
+			wflags.TlsMode = imap.TLS_STARTTLS
+		}
+	}
+
+	if !imap.TLSModeValid(wflags.TlsMode) {
+		return newFlagsError("Unknown TLS mode: \"%s\". Must be one of: implicit, starttls, plaintext.", wflags.TlsMode)
+	} else if wflags.TlsMode == imap.TLS_PLAINTEXT && !imap.IsLocalhost(wflags.Host) {
+		return newFlagsError("Plaintext connections are only allowed to localhost.")
+	} else if _, ok := imap.TLSVersion(wflags.TlsMinVersion); !ok {
+		return newFlagsError("Unknown TLS version: \"%s\". Must be one of: 1.0, 1.1, 1.2, 1.3.", wflags.TlsMinVersion)
 	}
 
-	if !watch.DeliveryModeValid(wflags.Mode) {
-		return wflags, newFlagsError("Unknown delivery mode: \"%s\". Must be one of: %s.", wflags.Mode, strings.Join(watch.ValidDeliveryModes(), ", "))
-	} else if wflags.Mode == "postback" && wflags.PostbackUrl == "" {
-		return wflags, newFlagsError("On postback mode, delivery url must be specified.")
-	} else if wflags.Mode == "hipchat" && wflags.RoomAuth == "" {
-		return wflags, newFlagsError("On hipchat mode, room authentication token must be specified.")
-	} else if wflags.Mode == "hipchat" && wflags.RoomName == "" {
-		return wflags, newFlagsError("On hipchat mode, room name must be specified.")
+	for _, pin := range wflags.TlsPins {
+		if !imap.PinValid(pin) {
+			return newFlagsError("Invalid TLS pin: \"%s\". Must be formatted as sha256/<base64 digest>.", pin)
+		}
 	}
 
-	if wflags.Port == 143 && wflags.Ssl == true {
+	if wflags.TlsCAFile != "" {
+		if _, err := os.Stat(wflags.TlsCAFile); err != nil {
+			return newFlagsError("Invalid CA file: %s.", err)
+		}
+	}
+
+	if wflags.TlsMode == imap.TLS_IMPLICIT && wflags.Port == 143 {
 		wflags.Port = 993
-	} else if wflags.Port == 993 && wflags.Ssl == false {
-		wflags.Ssl = true
+	} else if wflags.TlsMode != imap.TLS_IMPLICIT && wflags.Port == 993 {
+		wflags.Port = 143
+	}
+	wflags.Ssl = wflags.TlsMode == imap.TLS_IMPLICIT
+
+	return nil
+}
+
+// checkAuthFlags checks the authentication mechanism and loads the client
+// certificate, if any.
+func checkAuthFlags(wflags *watch.Flags) error {
+	if wflags.AuthMechanism != "" && !imap.MechanismValid(wflags.AuthMechanism) {
+		return newFlagsError("Unknown authentication mechanism: \"%s\". Must be one of: %s.", wflags.AuthMechanism, strings.ToLower(strings.Join(imap.MECHANISMS, ", ")))
+	} else if strings.EqualFold(wflags.AuthMechanism, imap.MECHANISM_EXTERNAL) && wflags.TlsCert == "" {
+		return newFlagsError("On external authentication, TLS client certificate must be specified.")
+	} else if wflags.AuthIdentity != "" && (strings.EqualFold(wflags.AuthMechanism, imap.MECHANISM_LOGIN) || strings.EqualFold(wflags.AuthMechanism, imap.MECHANISM_CRAM_MD5)) {
+		return newFlagsError("The %s authentication mechanism does not support an authorization identity.", strings.ToLower(wflags.AuthMechanism))
+	}
+
+	if wflags.TlsCert != "" && wflags.TlsKey == "" {
+		wflags.TlsKey = wflags.TlsCert
+	}
+	if wflags.TlsCert != "" {
+		if _, err := tls.LoadX509KeyPair(wflags.TlsCert, wflags.TlsKey); err != nil {
+			return newFlagsError("Invalid TLS client certificate: %s.", err)
+		}
+	}
+
+	return nil
+}
+
+// checkOAuthFlags checks the oauth2 client, when there is one.
+func checkOAuthFlags(wflags *watch.Flags) error {
+	if wflags.OAuthProvider == "" {
+		return nil
+	}
+
+	if !oauth.ProviderValid(wflags.OAuthProvider) {
+		return newFlagsError("Unknown OAuth2 provider: \"%s\". Must be one of: google, microsoft.", wflags.OAuthProvider)
+	} else if wflags.OAuthClientId == "" {
+		return newFlagsError("On OAuth2 authentication, client id must be specified.")
+	} else if wflags.OAuthTokenFile == "" {
+		return newFlagsError("On OAuth2 authentication, token file must be specified.")
+	}
+
+	return nil
+}
+
+// setupLogger sets the default logger, and the redaction of logs, as
+// configured.
+func setupLogger(cfg *config) error {
+	level, err := parseLogLevel(cfg.logLevel)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+
+	logger, err := newLogger(cfg.logFormat)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	redact.MaxBodyLength = cfg.logBodyMax
+	redact.HashAddresses = cfg.logHashAddresses
+
+	return nil
+}
+
+// newLogger creates the logger of all components, writing to stdout at
+// logLevel. Secrets, bodies and addresses are redacted.
+func newLogger(format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "text", "logfmt":
+		return slog.New(redact.NewHandler(slog.NewTextHandler(os.Stdout, opts))), nil
+	case "json":
+		return slog.New(redact.NewHandler(slog.NewJSONHandler(os.Stdout, opts))), nil
 	}
 
-	return wflags, nil
+	return nil, newFlagsError("Unknown log format: \"%s\". Must be one of: text, json.", format)
 }
 
-func usageMessage() string {
+func parseLogLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return lvl, newFlagsError("Unknown log level: \"%s\". Must be one of: debug, info, warn, error.", level)
+	}
+
+	return lvl, nil
+}
+
+func logFormatValid(format string) bool {
+	return format == "text" || format == "logfmt" || format == "json"
+}
+
+func hasQueueMode(wflags *watch.Flags) bool {
+	return wflags.HasMode("amqp") || wflags.HasMode("nats") || wflags.HasMode("kafka")
+}
+
+func usageMessage(flags *flag.FlagSet) string {
 	var usageStr string
 
 	usageStr = "IMAP idling daemon which delivers incoming email to a webhook.\n\n"
 
 	usageStr += "Usage:\n"
-	usageStr += fmt.Sprintf("  %s [OPTIONS]\n", version.App())
+	usageStr += fmt.Sprintf("  %s [OPTIONS] [run]\n", version.App())
+	usageStr += fmt.Sprintf("  %s [OPTIONS] check\n", version.App())
+	usageStr += fmt.Sprintf("  %s [OPTIONS] mailboxes\n", version.App())
+	usageStr += fmt.Sprintf("  %s [OPTIONS] deliver --file=<message.eml>\n", version.App())
+	usageStr += fmt.Sprintf("  %s [OPTIONS] backfill [--since=<YYYY-MM-DD>] [--dry-run]\n", version.App())
+	usageStr += fmt.Sprintf("  %s [OPTIONS] auth login\n", version.App())
+	usageStr += fmt.Sprintf("  %s [OPTIONS] config print\n", version.App())
 
 	usageStr += "\nOptions are:\n"
 
-	flag.VisitAll(func(f *flag.Flag) {
+	flags.VisitAll(func(f *flag.Flag) {
 		if len(f.Shorthand) > 0 {
 			usageStr += fmt.Sprintf("  -%s, --%s\r\t\t\t%s\n", f.Shorthand, f.Name, f.Usage)
 		} else {
@@ -211,10 +452,6 @@ func printMessageAndExit(format string, args ...interface{}) {
 	os.Exit(1)
 }
 
-func printUsage() {
-	printMessage(usageMessage())
-}
-
 func newError(format string, args ...interface{}) error {
 	return fmt.Errorf(format, args...)
 }
@@ -0,0 +1,125 @@
+// Package metrics exposes postman activity as Prometheus metrics.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "postman"
+
+	// delivery outcomes
+	OUTCOME_SUCCESS   = "success"
+	OUTCOME_TEMPORARY = "temporary_failure"
+	OUTCOME_PERMANENT = "permanent_failure"
+)
+
+var (
+	// MessagesFetched counts messages fetched from the server, per mailbox.
+	MessagesFetched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_fetched_total",
+		Help:      "Number of messages fetched from the IMAP server.",
+	}, []string{"mailbox"})
+
+	// Deliveries counts delivery attempts, per handler and outcome.
+	Deliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deliveries_total",
+		Help:      "Number of delivery attempts, by handler and outcome.",
+	}, []string{"handler", "outcome"})
+
+	// DeliveryDuration observes the duration of delivery attempts, per handler.
+	DeliveryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delivery_duration_seconds",
+		Help:      "Duration of delivery attempts, by handler.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"handler"})
+
+	// RetryQueueDepth is the number of deliveries waiting for a retry.
+	RetryQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "retry_queue_depth",
+		Help:      "Number of deliveries waiting to be retried.",
+	})
+
+	// ImapReconnects counts connections to the server after the first one.
+	ImapReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "imap_reconnects_total",
+		Help:      "Number of reconnections to the IMAP server.",
+	}, []string{"mailbox"})
+
+	// IdleCycles counts completed IDLE commands.
+	IdleCycles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "imap_idle_cycles_total",
+		Help:      "Number of completed IMAP IDLE cycles.",
+	}, []string{"mailbox"})
+
+	lastIdle = &idleCollector{
+		last: map[string]time.Time{},
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "imap", "last_idle_seconds"),
+			"Seconds since the last successful IMAP IDLE cycle.",
+			[]string{"mailbox"}, nil),
+	}
+)
+
+// idleCollector reports the time elapsed since the last successful IDLE of
+// each mailbox, computed at scrape time.
+type idleCollector struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+	desc *prometheus.Desc
+}
+
+func (c *idleCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *idleCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for mailbox, last := range c.last {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(last).Seconds(), mailbox)
+	}
+}
+
+// IdleSucceeded records a successful IDLE cycle on mailbox.
+func IdleSucceeded(mailbox string) {
+	IdleCycles.WithLabelValues(mailbox).Inc()
+
+	lastIdle.mu.Lock()
+	lastIdle.last[mailbox] = time.Now()
+	lastIdle.mu.Unlock()
+}
+
+// Delivered records the outcome and duration of a delivery attempt.
+func Delivered(handler string, outcome string, duration time.Duration) {
+	Deliveries.WithLabelValues(handler, outcome).Inc()
+	DeliveryDuration.WithLabelValues(handler).Observe(duration.Seconds())
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func init() {
+	prometheus.MustRegister(
+		MessagesFetched,
+		Deliveries,
+		DeliveryDuration,
+		RetryQueueDepth,
+		ImapReconnects,
+		IdleCycles,
+		lastIdle)
+}
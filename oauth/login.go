@@ -0,0 +1,118 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// Login obtains a token from the provider with flow, showing instructions on
+// out, and stores it in the token file. Username, if any, is suggested to the
+// provider as the account to log in.
+func Login(ctx context.Context, config *Config, flow string, username string, out io.Writer) (*oauth2.Token, error) {
+	var token *oauth2.Token
+	var err error
+
+	switch flow {
+	case FLOW_DEVICE:
+		token, err = loginDevice(ctx, config, out)
+	case FLOW_LOOPBACK:
+		token, err = loginLoopback(ctx, config, username, out)
+	default:
+		return nil, fmt.Errorf("unknown login flow: %s", flow)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.RefreshToken == "" {
+		return nil, fmt.Errorf("the provider granted no refresh token")
+	}
+
+	return token, SaveToken(config.TokenFile, token)
+}
+
+// loginDevice runs the device authorization grant of RFC 8628: the user
+// enters a code on a web page of the provider, from any device.
+func loginDevice(ctx context.Context, config *Config, out io.Writer) (*oauth2.Token, error) {
+	conf := config.oauth2Config("")
+
+	auth, err := conf.DeviceAuth(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth.VerificationURIComplete != "" {
+		fmt.Fprintf(out, "Open this url in a browser to log in:\n\n  %s\n\n", auth.VerificationURIComplete)
+	} else {
+		fmt.Fprintf(out, "Open this url in a browser and enter the code %s to log in:\n\n  %s\n\n", auth.UserCode, auth.VerificationURI)
+	}
+
+	return conf.DeviceAccessToken(ctx, auth)
+}
+
+// loginLoopback runs the authorization code grant with PKCE, the provider
+// redirecting the browser to a local http server (RFC 8252).
+func loginLoopback(ctx context.Context, config *Config, username string, out io.Writer) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	conf := config.oauth2Config(fmt.Sprintf("http://%s/", listener.Addr()))
+	state := randomString()
+	verifier := oauth2.GenerateVerifier()
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case query.Get("state") != state:
+			http.Error(w, "Invalid state.", http.StatusBadRequest)
+			return
+		case query.Get("error") != "":
+			http.Error(w, "Login failed, you can close this window.", http.StatusForbidden)
+			select {
+			case errs <- fmt.Errorf("login failed: %s %s", query.Get("error"), query.Get("error_description")):
+			default:
+			}
+		default:
+			fmt.Fprintln(w, "Logged in, you can close this window.")
+			select {
+			case codes <- query.Get("code"):
+			default:
+			}
+		}
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	opts := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline, oauth2.ApprovalForce, oauth2.S256ChallengeOption(verifier)}
+	if username != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("login_hint", username))
+	}
+	fmt.Fprintf(out, "Open this url in a browser to log in:\n\n  %s\n\n", conf.AuthCodeURL(state, opts...))
+
+	select {
+	case code := <-codes:
+		return conf.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	case err := <-errs:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,181 @@
+// Package oauth provides OAuth2 access tokens for IMAP authentication, from
+// a refresh token stored in a file by the login flows of the auth command.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/etrepat/postman/internal/fileutil"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+const (
+	PROVIDER_GOOGLE    = "google"
+	PROVIDER_MICROSOFT = "microsoft"
+
+	FLOW_DEVICE   = "device"
+	FLOW_LOOPBACK = "loopback"
+)
+
+var (
+	PROVIDERS = map[string]bool{
+		PROVIDER_GOOGLE:    true,
+		PROVIDER_MICROSOFT: true}
+
+	FLOWS = map[string]bool{
+		FLOW_DEVICE:   true,
+		FLOW_LOOPBACK: true}
+
+	// imap access scopes
+	scopes = map[string][]string{
+		PROVIDER_GOOGLE:    {"https://mail.google.com/"},
+		PROVIDER_MICROSOFT: {"https://outlook.office.com/IMAP.AccessAsUser.All", "offline_access"}}
+)
+
+// Config is the OAuth2 client of a provider.
+type Config struct {
+	Provider     string
+	ClientId     string
+	ClientSecret string
+	// microsoft only, "common" when empty
+	Tenant string
+	// where the token is stored
+	TokenFile string
+}
+
+// oauth2Config returns the oauth2 configuration of the provider, redirecting
+// to redirectURL in the loopback flow.
+func (c *Config) oauth2Config(redirectURL string) *oauth2.Config {
+	conf := &oauth2.Config{
+		ClientID:     c.ClientId,
+		ClientSecret: c.ClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       scopes[c.Provider]}
+
+	switch c.Provider {
+	case PROVIDER_GOOGLE:
+		conf.Endpoint = endpoints.Google
+	case PROVIDER_MICROSOFT:
+		conf.Endpoint = endpoints.AzureAD(c.Tenant)
+	}
+
+	return conf
+}
+
+// DefaultFlow is the login flow supported by the provider for imap scopes:
+// google does not grant them to devices.
+func (c *Config) DefaultFlow() string {
+	if c.Provider == PROVIDER_GOOGLE {
+		return FLOW_LOOPBACK
+	}
+
+	return FLOW_DEVICE
+}
+
+// TokenSource refreshes access tokens from the token stored in the token
+// file, which it updates with each new token. The file is first read when a
+// token is needed, and read again once changed by another login.
+type TokenSource struct {
+	config *Config
+
+	mu       sync.Mutex
+	token    *oauth2.Token
+	source   oauth2.TokenSource
+	modified time.Time
+}
+
+func (s *TokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.config.TokenFile)
+	if s.source == nil || (err == nil && !info.ModTime().Equal(s.modified)) {
+		token, err := LoadToken(s.config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		s.token = token
+		s.source = s.config.oauth2Config("").TokenSource(context.Background(), token)
+		if info != nil {
+			s.modified = info.ModTime()
+		}
+	}
+
+	token, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// providers may rotate the refresh token too
+	if token.AccessToken != s.token.AccessToken || token.RefreshToken != s.token.RefreshToken {
+		if err := SaveToken(s.config.TokenFile, token); err != nil {
+			return nil, err
+		}
+		s.token = token
+		if info, err := os.Stat(s.config.TokenFile); err == nil {
+			s.modified = info.ModTime()
+		}
+	}
+
+	return token, nil
+}
+
+func NewTokenSource(config *Config) *TokenSource {
+	return &TokenSource{config: config}
+}
+
+// LoadToken reads a token stored by SaveToken.
+func LoadToken(path string) (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no OAuth2 token in %s, run the \"auth login\" command first", path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("invalid OAuth2 token in %s: %s", path, err)
+	}
+	if token.RefreshToken == "" {
+		return nil, fmt.Errorf("no refresh token in %s", path)
+	}
+
+	return token, nil
+}
+
+// SaveToken atomically writes token to path, only readable by its owner.
+func SaveToken(path string, token *oauth2.Token) error {
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutil.WriteFileAtomic(path, data)
+}
+
+// DefaultTokenFile is the token file in the user configuration directory.
+func DefaultTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "postman-token.json"
+	}
+
+	return filepath.Join(dir, "postman", "token.json")
+}
+
+func ProviderValid(provider string) bool {
+	return PROVIDERS[provider]
+}
+
+func FlowValid(flow string) bool {
+	return FLOWS[flow]
+}
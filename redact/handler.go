@@ -0,0 +1,108 @@
+package redact
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+var (
+	// log attributes holding secrets, always masked
+	SecretKeys = map[string]bool{
+		"password": true,
+		"token":    true,
+		"secret":   true,
+		"auth":     true}
+
+	// log attributes holding message bodies, only logged at debug level and
+	// truncated
+	BodyKeys = map[string]bool{
+		"body":   true,
+		"text":   true,
+		"html":   true,
+		"output": true}
+
+	// log attributes holding email addresses, hashed if HashAddresses is on
+	AddressKeys = map[string]bool{
+		"account":   true,
+		"from":      true,
+		"to":        true,
+		"cc":        true,
+		"sender":    true,
+		"recipient": true,
+		"address":   true}
+)
+
+// Handler redacts the attributes of log records before handing them to the
+// next handler.
+type Handler struct {
+	next slog.Handler
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	debug := record.Level <= slog.LevelDebug
+
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr, ok := redactAttr(attr, debug); ok {
+			redacted.AddAttrs(attr)
+		}
+		return true
+	})
+
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := []slog.Attr{}
+	for _, attr := range attrs {
+		// bodies are not meant to be shared by several log entries
+		if attr, ok := redactAttr(attr, false); ok {
+			redacted = append(redacted, attr)
+		}
+	}
+
+	return &Handler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name)}
+}
+
+// redactAttr returns the redacted attribute, and whether to keep it at all.
+func redactAttr(attr slog.Attr, debug bool) (slog.Attr, bool) {
+	key := strings.ToLower(attr.Key)
+	// LogValuer values are only known once resolved
+	attr.Value = attr.Value.Resolve()
+
+	switch {
+	case attr.Value.Kind() == slog.KindGroup:
+		attrs := []any{}
+		for _, a := range attr.Value.Group() {
+			if a, ok := redactAttr(a, debug); ok {
+				attrs = append(attrs, a)
+			}
+		}
+		return slog.Group(attr.Key, attrs...), true
+	case SecretKeys[key]:
+		return slog.String(attr.Key, Secret(attr.Value.String())), true
+	case BodyKeys[key]:
+		if !debug {
+			return attr, false
+		}
+		return slog.String(attr.Key, Body(attr.Value.String())), true
+	case AddressKeys[key]:
+		return slog.String(attr.Key, Address(attr.Value.String())), true
+	}
+
+	return attr, true
+}
+
+// NewHandler wraps next with redaction.
+func NewHandler(next slog.Handler) *Handler {
+	return &Handler{next: next}
+}
@@ -0,0 +1,86 @@
+// Package redact keeps secrets, message bodies and email addresses out of logs
+// and other outputs.
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+)
+
+const (
+	// MASK replaces secrets
+	MASK = "******"
+
+	// DEFAULT_MAX_BODY_LENGTH is the default length bodies are truncated to
+	DEFAULT_MAX_BODY_LENGTH = 1024
+)
+
+var (
+	// MaxBodyLength is the maximum number of characters of a body, 0 for no
+	// limit.
+	MaxBodyLength = DEFAULT_MAX_BODY_LENGTH
+
+	// HashAddresses replaces email addresses with a digest, which still
+	// allows to correlate log entries.
+	HashAddresses = false
+)
+
+// Secret masks a secret, an empty secret is left empty to tell it is unset.
+func Secret(s string) string {
+	if s == "" {
+		return ""
+	}
+
+	return MASK
+}
+
+// Body truncates a message body to MaxBodyLength characters.
+func Body(s string) string {
+	runes := []rune(s)
+	if MaxBodyLength <= 0 || len(runes) <= MaxBodyLength {
+		return s
+	}
+
+	return fmt.Sprintf("%s... (%d more chars)", string(runes[:MaxBodyLength]), len(runes)-MaxBodyLength)
+}
+
+// Address hashes the addresses of an address list header value, if
+// HashAddresses is on. Display names are dropped along.
+func Address(s string) string {
+	if !HashAddresses || s == "" {
+		return s
+	}
+
+	list, err := mail.ParseAddressList(s)
+	if err != nil {
+		return hash(s)
+	}
+
+	hashed := make([]string, len(list))
+	for i, addr := range list {
+		hashed[i] = hash(addr.Address)
+	}
+
+	return strings.Join(hashed, ", ")
+}
+
+// URL strips credentials, query and fragment from an url. An url which can
+// not be parsed is masked as a whole, as it may hold credentials.
+func URL(u string) string {
+	uri, err := url.Parse(u)
+	if err != nil {
+		return MASK
+	}
+
+	return uri.Scheme + "://" + uri.Host + uri.Path
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(s))))
+
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
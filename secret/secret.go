@@ -0,0 +1,103 @@
+// Package secret reads passwords and tokens from files or helper commands
+// rather than the command line, where they show in ps.
+package secret
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// suffix of environment variables naming the file of a secret
+	FILE_SUFFIX = "_FILE"
+
+	COMMAND_TIMEOUT = 30 * time.Second
+)
+
+// Source provides a secret. Files and commands are read again on each call,
+// so that rotated secrets are picked up.
+type Source interface {
+	Secret() (string, error)
+}
+
+// Value is a secret given as is.
+type Value string
+
+func (v Value) Secret() (string, error) {
+	return string(v), nil
+}
+
+// File is the path of a file holding a secret, ie: a docker or kubernetes
+// secret.
+type File string
+
+func (f File) Secret() (string, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return "", fmt.Errorf("could not read secret file: %s", err)
+	}
+
+	return trimNewline(string(data)), nil
+}
+
+// Command is a shell command printing a secret on stdout, ie: "pass show
+// imap" or "op read op://vault/imap/password".
+type Command string
+
+func (c Command) Secret() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), COMMAND_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", string(c))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("secret command failed: %s", err)
+	}
+
+	return trimNewline(string(out)), nil
+}
+
+// New returns the source of a secret given either by command, by file or as
+// a value, in this order of precedence.
+func New(value string, file string, command string) Source {
+	if command != "" {
+		return Command(command)
+	} else if file != "" {
+		return File(file)
+	}
+
+	return Value(value)
+}
+
+// LookupEnv returns the value of the environment variable name or else,
+// following the docker secrets convention, the content of the file named by
+// the variable with the _FILE suffix, ie: POSTMAN_PASSWORD_FILE.
+func LookupEnv(name string) (string, bool, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+
+	path := os.Getenv(name + FILE_SUFFIX)
+	if path == "" {
+		return "", false, nil
+	}
+
+	value, err := File(path).Secret()
+	if err != nil {
+		return "", false, fmt.Errorf("%s%s: %s", name, FILE_SUFFIX, err)
+	}
+
+	return value, true, nil
+}
+
+// trimNewline drops the line ending of a secret written by an editor or
+// printed by echo.
+func trimNewline(secret string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(secret, "\n"), "\r")
+}
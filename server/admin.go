@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/etrepat/postman/watch"
+)
+
+type watchInfo struct {
+	ID int `json:"id"`
+	watch.Status
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// admin serves the admin api, below /admin/:
+//
+//	GET  /admin/watches
+//	GET  /admin/watches/{id}
+//	POST /admin/watches/{id}/pause
+//	POST /admin/watches/{id}/resume
+//	POST /admin/watches/{id}/resync
+//	GET  /admin/watches/{id}/retries
+//	POST /admin/watches/{id}/retries/{retry}/replay
+//	GET  /admin/watches/{id}/dead-letters
+//	POST /admin/watches/{id}/dead-letters/replay
+//	POST /admin/watches/{id}/dead-letters/{letter}/replay
+//	GET  /admin/watches/{id}/history
+//
+// Requests must carry the admin token as a bearer token. Without a token, the
+// admin api is disabled.
+func (s *Server) admin(w http.ResponseWriter, r *http.Request) {
+	if s.AdminToken == "" {
+		http.NotFound(w, r)
+		return
+	} else if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="postman"`)
+		writeJSON(w, http.StatusUnauthorized, apiError{"Unauthorized"})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+	if parts[0] != "watches" {
+		writeJSON(w, http.StatusNotFound, apiError{"Not found"})
+		return
+	}
+
+	if len(parts) == 1 {
+		if !allowed(w, r, "GET") {
+			return
+		}
+
+		watches := []watchInfo{}
+		for i, wt := range s.watches {
+			watches = append(watches, watchInfo{i, wt.Status()})
+		}
+		writeJSON(w, http.StatusOK, watches)
+		return
+	}
+
+	id, err := strconv.Atoi(parts[1])
+	if err != nil || id < 0 || id >= len(s.watches) {
+		writeJSON(w, http.StatusNotFound, apiError{fmt.Sprintf("No watch with id %s", parts[1])})
+		return
+	}
+	wt := s.watches[id]
+
+	switch strings.Join(parts[2:], "/") {
+	case "":
+		if allowed(w, r, "GET") {
+			writeJSON(w, http.StatusOK, watchInfo{id, wt.Status()})
+		}
+	case "pause":
+		if allowed(w, r, "POST") {
+			wt.Pause()
+			writeJSON(w, http.StatusOK, watchInfo{id, wt.Status()})
+		}
+	case "resume":
+		if allowed(w, r, "POST") {
+			wt.Resume()
+			writeJSON(w, http.StatusOK, watchInfo{id, wt.Status()})
+		}
+	case "resync":
+		if allowed(w, r, "POST") {
+			wt.Resync()
+			writeJSON(w, http.StatusAccepted, watchInfo{id, wt.Status()})
+		}
+	case "retries":
+		if allowed(w, r, "GET") {
+			writeJSON(w, http.StatusOK, wt.RetryQueue())
+		}
+	case "dead-letters":
+		if allowed(w, r, "GET") {
+			writeJSON(w, http.StatusOK, wt.DeadLetters())
+		}
+	case "dead-letters/replay":
+		if allowed(w, r, "POST") {
+			replayed := []uint64{}
+			for _, dl := range wt.DeadLetters() {
+				if wt.Replay(dl.ID) == nil {
+					replayed = append(replayed, dl.ID)
+				}
+			}
+			writeJSON(w, http.StatusAccepted, map[string][]uint64{"replayed": replayed})
+		}
+	case "history":
+		if allowed(w, r, "GET") {
+			writeJSON(w, http.StatusOK, wt.History())
+		}
+	default:
+		// {queue}/{id}/replay
+		if len(parts) != 5 || parts[4] != "replay" {
+			writeJSON(w, http.StatusNotFound, apiError{"Not found"})
+			return
+		}
+
+		var replay func(uint64) error
+		switch parts[2] {
+		case "retries":
+			replay = wt.RetryNow
+		case "dead-letters":
+			replay = wt.Replay
+		default:
+			writeJSON(w, http.StatusNotFound, apiError{"Not found"})
+			return
+		}
+
+		entry, err := strconv.ParseUint(parts[3], 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, apiError{fmt.Sprintf("Invalid id %s", parts[3])})
+			return
+		}
+
+		if allowed(w, r, "POST") {
+			if err = replay(entry); err != nil {
+				writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusAccepted, map[string][]uint64{"replayed": {entry}})
+		}
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) == 1
+}
+
+// allowed answers 405 to requests not using method.
+func allowed(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"Method not allowed"})
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,189 @@
+// Package server implements the http endpoints of postman: health checks,
+// readiness, metrics and the admin api.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/etrepat/postman/metrics"
+	"github.com/etrepat/postman/watch"
+)
+
+const (
+	// DefaultIdleCycles is the default number of IDLE intervals allowed
+	// without a successful round-trip with the server.
+	DefaultIdleCycles = 2
+
+	// checkTimeout bounds the handler target checks of a readiness probe.
+	checkTimeout = 5 * time.Second
+
+	// checkCacheTTL is how long the results of handler target checks are
+	// reused, so that frequent probes do not hammer the targets.
+	checkCacheTTL = 10 * time.Second
+)
+
+type Server struct {
+	Addr string
+	// IdleCycles is how many IDLE intervals may elapse since the last
+	// successful IDLE round-trip before a watch is not ready anymore.
+	IdleCycles int
+	// AdminToken enables the admin api, authenticating its requests.
+	AdminToken string
+
+	watches []*watch.Watch
+	mux     *http.ServeMux
+
+	checksMu sync.Mutex
+	checks   map[*watch.Watch]cachedChecks
+}
+
+// cachedChecks are the results of the handler target checks of a watch.
+type cachedChecks struct {
+	at     time.Time
+	checks []watch.HandlerCheck
+}
+
+type check struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type watchReadiness struct {
+	watch.Status
+	Ready  bool    `json:"ready"`
+	Checks []check `json:"checks"`
+}
+
+type readiness struct {
+	Ready   bool             `json:"ready"`
+	Watches []watchReadiness `json:"watches"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) ListenAndServe() error {
+	return http.ListenAndServe(s.Addr, s)
+}
+
+// healthz reports the process is alive.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether every watch is able to receive and deliver messages,
+// along with the details of each check.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	result := readiness{Ready: true, Watches: []watchReadiness{}}
+	for _, wt := range s.watches {
+		ready := s.watchReadiness(ctx, wt)
+		result.Ready = result.Ready && ready.Ready
+		result.Watches = append(result.Watches, ready)
+	}
+
+	status := http.StatusOK
+	if !result.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, result)
+}
+
+func (s *Server) watchReadiness(ctx context.Context, wt *watch.Watch) watchReadiness {
+	status := wt.Status()
+	ready := watchReadiness{Status: status, Ready: true}
+
+	add := func(name string, err error) {
+		c := check{Name: name, Ok: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			ready.Ready = false
+		}
+		ready.Checks = append(ready.Checks, c)
+	}
+
+	switch {
+	case !status.Connected:
+		add("imap", fmt.Errorf("not logged in"))
+	case !status.Selected:
+		add("imap", fmt.Errorf("mailbox %s not selected", status.Mailbox))
+	default:
+		add("imap", nil)
+	}
+
+	maxIdle := time.Duration(s.IdleCycles) * wt.IdleInterval()
+	if status.LastIdle.IsZero() {
+		add("idle", fmt.Errorf("no IDLE round-trip yet"))
+	} else if since := time.Since(status.LastIdle); since > maxIdle {
+		add("idle", fmt.Errorf("last IDLE round-trip %s ago, over %s", since.Truncate(time.Second), maxIdle))
+	} else {
+		add("idle", nil)
+	}
+
+	if status.Queued >= status.QueueCapacity && status.Pending > 0 {
+		add("spool", fmt.Errorf("delivery queue full (%d), %d messages waiting on the server", status.Queued, status.Pending))
+	} else {
+		add("spool", nil)
+	}
+
+	for _, hc := range s.checkHandlers(ctx, wt) {
+		add("handler:"+hc.Name, hc.Err)
+	}
+
+	return ready
+}
+
+// checkHandlers checks the handler targets of wt, or returns the results of
+// the last check when done less than checkCacheTTL ago. Concurrent probes
+// wait for a single check.
+func (s *Server) checkHandlers(ctx context.Context, wt *watch.Watch) []watch.HandlerCheck {
+	s.checksMu.Lock()
+	defer s.checksMu.Unlock()
+
+	if cached, ok := s.checks[wt]; ok && time.Since(cached.at) < checkCacheTTL {
+		return cached.checks
+	}
+
+	checks := wt.CheckHandlers(ctx)
+	s.checks[wt] = cachedChecks{at: time.Now(), checks: checks}
+
+	return checks
+}
+
+// root keeps answering the legacy health check on any path.
+func (s *Server) root(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Service responding from %s", r.URL.Path[1:])
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func New(addr string, watches ...*watch.Watch) *Server {
+	s := &Server{
+		Addr:       addr,
+		IdleCycles: DefaultIdleCycles,
+		watches:    watches,
+		mux:        http.NewServeMux(),
+		checks:     map[*watch.Watch]cachedChecks{}}
+
+	s.mux.Handle("/metrics", metrics.Handler())
+	s.mux.HandleFunc("/healthz", s.healthz)
+	s.mux.HandleFunc("/readyz", s.readyz)
+	s.mux.HandleFunc("/admin/", s.admin)
+	s.mux.HandleFunc("/", s.root)
+
+	return s
+}
@@ -0,0 +1,92 @@
+// Package tracing sets up OpenTelemetry tracing, exported with OTLP over http.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/etrepat/postman/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/etrepat/postman"
+
+// span attributes
+const (
+	ACCOUNT    = attribute.Key("postman.account")
+	MAILBOX    = attribute.Key("postman.mailbox")
+	UID        = attribute.Key("postman.uid")
+	MESSAGE_ID = attribute.Key("postman.message_id")
+	HANDLER    = attribute.Key("postman.handler")
+	ATTEMPT    = attribute.Key("postman.attempt")
+)
+
+// Tracer returns the tracer of postman. Until Setup enables an exporter,
+// spans are not recorded.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// Setup propagates W3C trace context and, when endpoint is set or the
+// standard OTEL_EXPORTER_OTLP_* environment variables are, exports traces to
+// an OTLP collector. Endpoint is either a host:port or an url. The returned
+// function flushes pending spans and stops the exporter.
+func Setup(ctx context.Context, endpoint string, insecure bool) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{}
+	if strings.Contains(endpoint, "://") {
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	} else if endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+	}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", "postman"),
+			attribute.String("service.version", version.VERSION)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost())
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Inject adds the trace context of ctx to headers, ie: the traceparent header.
+func Inject(ctx context.Context, headers map[string]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+}
+
+// InjectHTTP adds the trace context of ctx to http headers.
+func InjectHTTP(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,264 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/etrepat/postman/handler"
+	"github.com/etrepat/postman/internal/fileutil"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_BACKFILL_BATCH = 100
+	DEFAULT_BACKFILL_RATE  = 10
+)
+
+// characters of account and mailbox names kept in state file names
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// BackfillOptions tell which messages of the mailbox a backfill delivers,
+// and how fast.
+type BackfillOptions struct {
+	// day of the oldest message, all messages when zero
+	Since time.Time
+	// messages fetched at once
+	BatchSize int
+	// maximum messages delivered per second, 0 for no limit
+	Rate float64
+	// file where progress is saved, and resumed from
+	StateFile string
+	// only log the messages which would be delivered
+	DryRun bool
+}
+
+// BackfillState is the progress of a backfill. It is saved after each batch,
+// so that an interrupted backfill resumes after the last message handled.
+// Messages which could not be delivered are tried again on resume.
+type BackfillState struct {
+	Account     string    `json:"account"`
+	Mailbox     string    `json:"mailbox"`
+	Since       string    `json:"since"`
+	UIDValidity uint32    `json:"uidvalidity"`
+	LastUID     uint32    `json:"last_uid"`
+	Delivered   int       `json:"delivered"`
+	Failed      []uint32  `json:"failed"`
+	Updated     time.Time `json:"updated"`
+}
+
+// pending reports whether the message uid is yet to be delivered.
+func (s *BackfillState) pending(uid uint32) bool {
+	return uid > s.LastUID || s.failed(uid)
+}
+
+func (s *BackfillState) failed(uid uint32) bool {
+	for _, f := range s.Failed {
+		if f == uid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handled records the outcome of the delivery of the message uid.
+func (s *BackfillState) handled(uid uint32, err error) {
+	failed := []uint32{}
+	for _, f := range s.Failed {
+		if f != uid {
+			failed = append(failed, f)
+		}
+	}
+	if err != nil {
+		failed = append(failed, uid)
+	} else {
+		s.Delivered++
+	}
+	s.Failed = failed
+
+	if uid > s.LastUID {
+		s.LastUID = uid
+	}
+}
+
+// Backfill delivers the messages already in the mailbox, oldest UIDs first,
+// through the delivery chain. Messages are not marked as seen. It returns the
+// progress, saved to opts.StateFile unless on a dry run, once done or ctx is
+// cancelled.
+func (w *Watch) Backfill(ctx context.Context, opts *BackfillOptions) (*BackfillState, error) {
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	defer w.cancel()
+
+	since := ""
+	if !opts.Since.IsZero() {
+		since = opts.Since.Format("2006-01-02")
+	}
+
+	state, err := LoadBackfillState(opts.StateFile)
+	if err != nil {
+		return nil, err
+	} else if state == nil {
+		state = &BackfillState{Account: w.client.Username, Mailbox: w.mailbox, Since: since}
+	} else if state.Account != w.client.Username || state.Mailbox != w.mailbox || state.Since != since {
+		return nil, fmt.Errorf("%s holds the progress of another backfill (%s, mailbox %s, since %s)", opts.StateFile, state.Account, state.Mailbox, state.Since)
+	}
+
+	w.logger.Info("connecting", "server", w.client.Addr())
+	if err := w.client.Connect(); err != nil {
+		return state, err
+	}
+	defer w.client.Disconnect()
+
+	if err := w.client.Examine(w.mailbox); err != nil {
+		return state, err
+	}
+	if state.UIDValidity == 0 {
+		state.UIDValidity = w.client.UIDValidity()
+	} else if state.UIDValidity != w.client.UIDValidity() {
+		return state, fmt.Errorf("UIDVALIDITY of mailbox %s changed, remove %s to backfill it again", w.mailbox, opts.StateFile)
+	}
+
+	all, err := w.client.Since(opts.Since)
+	if err != nil {
+		return state, err
+	}
+	uids := []uint32{}
+	for _, uid := range all {
+		if state.pending(uid) {
+			uids = append(uids, uid)
+		}
+	}
+	w.logger.Info("backfilling", "since", since, "messages", len(all), "pending", len(uids), "dry_run", opts.DryRun)
+
+	batch := opts.BatchSize
+	if batch < 1 {
+		batch = DEFAULT_BACKFILL_BATCH
+	}
+
+	// dry runs deliver nothing to rate limit
+	var interval time.Duration
+	if opts.Rate > 0 && !opts.DryRun {
+		interval = time.Duration(float64(time.Second) / opts.Rate)
+	}
+	next := time.Now()
+
+	for start := 0; start < len(uids); start += batch {
+		end := start + batch
+		if end > len(uids) {
+			end = len(uids)
+		}
+
+		messages, err := w.client.Peek(uids[start:end], opts.DryRun)
+		if err != nil {
+			return state, err
+		}
+
+		for _, m := range messages {
+			if !sleepUntil(ctx, next) {
+				return state, w.saveBackfill(opts, state)
+			}
+			next = time.Now().Add(interval)
+
+			msgCtx, msg := w.newMessage(m)
+			if opts.DryRun {
+				w.logDryRun(msg)
+				trace.SpanFromContext(msgCtx).End()
+				continue
+			}
+
+			err := w.deliverChain(msgCtx, msg, 0, false)
+			if ctx.Err() != nil {
+				return state, w.saveBackfill(opts, state)
+			}
+			state.handled(m.UID, err)
+		}
+
+		if err := w.saveBackfill(opts, state); err != nil {
+			return state, err
+		}
+	}
+
+	return state, nil
+}
+
+// logDryRun logs a message a backfill would deliver.
+func (w *Watch) logDryRun(msg *handler.Message) {
+	logger := w.logger.With("uid", msg.UID, "message-id", messageId(msg))
+
+	header, err := msg.Header()
+	if err != nil {
+		logger.Info("would deliver")
+		return
+	}
+	logger.Info("would deliver", "date", header.Get("Date"), "from", header.Get("From"), "subject", header.Get("Subject"))
+}
+
+// saveBackfill saves the progress of a backfill, unless on a dry run.
+func (w *Watch) saveBackfill(opts *BackfillOptions, state *BackfillState) error {
+	if opts.DryRun {
+		return nil
+	}
+
+	state.Updated = time.Now()
+	return SaveBackfillState(opts.StateFile, state)
+}
+
+// sleepUntil waits for t, and reports whether ctx is still alive.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// LoadBackfillState reads the progress saved by SaveBackfillState, or
+// returns nil when there is none.
+func LoadBackfillState(path string) (*BackfillState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := &BackfillState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid backfill progress in %s: %s", path, err)
+	}
+
+	return state, nil
+}
+
+// SaveBackfillState atomically writes the progress of a backfill to path.
+func SaveBackfillState(path string, state *BackfillState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutil.WriteFileAtomic(path, data)
+}
+
+// DefaultBackfillStateFile is the progress file of the backfill of mailbox
+// in the user configuration directory.
+func DefaultBackfillStateFile(account string, mailbox string) string {
+	name := fmt.Sprintf("backfill-%s-%s.json", unsafeChars.ReplaceAllString(account, "_"), unsafeChars.ReplaceAllString(mailbox, "_"))
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return name
+	}
+
+	return filepath.Join(dir, "postman", name)
+}
@@ -0,0 +1,69 @@
+package watch
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestBackfillStateResume checks that a resumed backfill delivers the
+// messages after the last one handled, along with those which failed.
+func TestBackfillStateResume(t *testing.T) {
+	state := &BackfillState{Account: "support@example.com", Mailbox: "INBOX"}
+	failure := fmt.Errorf("Postback failed")
+
+	for _, uid := range []uint32{1, 2, 3, 4, 5} {
+		if !state.pending(uid) {
+			t.Errorf("pending(%d) = false on a new backfill", uid)
+		}
+	}
+
+	// interrupted after uid 4
+	state.handled(1, nil)
+	state.handled(2, failure)
+	state.handled(3, nil)
+	state.handled(4, failure)
+
+	if state.LastUID != 4 || state.Delivered != 2 || !reflect.DeepEqual(state.Failed, []uint32{2, 4}) {
+		t.Fatalf("state = last %d, delivered %d, failed %v, want 4, 2, [2 4]", state.LastUID, state.Delivered, state.Failed)
+	}
+
+	file := filepath.Join(t.TempDir(), "backfill.json")
+	if err := SaveBackfillState(file, state); err != nil {
+		t.Fatalf("SaveBackfillState() error = %v", err)
+	}
+	resumed, err := LoadBackfillState(file)
+	if err != nil {
+		t.Fatalf("LoadBackfillState() error = %v", err)
+	}
+
+	pending := []uint32{}
+	for _, uid := range []uint32{1, 2, 3, 4, 5} {
+		if resumed.pending(uid) {
+			pending = append(pending, uid)
+		}
+	}
+	if want := []uint32{2, 4, 5}; !reflect.DeepEqual(pending, want) {
+		t.Errorf("pending on resume = %v, want %v", pending, want)
+	}
+
+	// retried failures leave the failed list, or stay in it once
+	resumed.handled(2, nil)
+	resumed.handled(4, failure)
+	resumed.handled(5, nil)
+
+	if resumed.LastUID != 5 || resumed.Delivered != 4 || !reflect.DeepEqual(resumed.Failed, []uint32{4}) {
+		t.Errorf("state = last %d, delivered %d, failed %v, want 5, 4, [4]", resumed.LastUID, resumed.Delivered, resumed.Failed)
+	}
+	if resumed.pending(2) || !resumed.pending(4) {
+		t.Errorf("pending(2), pending(4) = %v, %v, want false, true", resumed.pending(2), resumed.pending(4))
+	}
+}
+
+func TestLoadBackfillStateMissing(t *testing.T) {
+	state, err := LoadBackfillState(filepath.Join(t.TempDir(), "backfill.json"))
+	if state != nil || err != nil {
+		t.Errorf("LoadBackfillState() = %v, %v, want nil, nil", state, err)
+	}
+}
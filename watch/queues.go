@@ -0,0 +1,211 @@
+package watch
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/etrepat/postman/handler"
+	"github.com/etrepat/postman/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// number of deliveries kept in the delivery history
+	HISTORY_SIZE = 100
+
+	// number of dead letters kept, the oldest ones are dropped first
+	DEAD_LETTERS_SIZE = 1000
+)
+
+// Delivery is the outcome of the delivery of a message through the chain.
+type Delivery struct {
+	UID       uint32        `json:"uid"`
+	MessageId string        `json:"message_id"`
+	Handler   string        `json:"handler,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Started   time.Time     `json:"started"`
+	Duration  time.Duration `json:"duration"`
+	Replayed  bool          `json:"replayed,omitempty"`
+}
+
+// Retry is a delivery waiting to be retried after a temporary failure.
+type Retry struct {
+	ID        uint64    `json:"id"`
+	UID       uint32    `json:"uid"`
+	MessageId string    `json:"message_id"`
+	Handler   string    `json:"handler"`
+	Attempt   uint      `json:"attempt"`
+	Error     string    `json:"error"`
+	Next      time.Time `json:"next"`
+
+	now chan struct{}
+}
+
+// DeadLetter is a message whose delivery failed for good. Replaying it
+// delivers it again, starting from the failed handler of the chain.
+type DeadLetter struct {
+	ID        uint64    `json:"id"`
+	UID       uint32    `json:"uid"`
+	MessageId string    `json:"message_id"`
+	Handler   string    `json:"handler"`
+	Error     string    `json:"error"`
+	Failed    time.Time `json:"failed"`
+
+	msg  *handler.Message
+	from int
+	span trace.SpanContext
+}
+
+// Pause stops fetching new messages, deliveries in progress go on and the
+// connection is kept alive.
+func (w *Watch) Pause() {
+	w.updateStatus(func(status *Status) { status.Paused = true })
+	w.wake()
+}
+
+// Resume fetches messages again, right away.
+func (w *Watch) Resume() {
+	w.updateStatus(func(status *Status) { status.Paused = false })
+	w.wake()
+}
+
+// Resync interrupts the current IDLE and looks for unseen messages right
+// away.
+func (w *Watch) Resync() {
+	w.wake()
+}
+
+func (w *Watch) wake() {
+	select {
+	case w.woken <- struct{}{}:
+	default:
+	}
+}
+
+// RetryQueue returns the deliveries waiting for a retry.
+func (w *Watch) RetryQueue() []Retry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	retries := []Retry{}
+	for _, retry := range w.retryQueue {
+		retries = append(retries, *retry)
+	}
+	sort.Slice(retries, func(i, j int) bool { return retries[i].ID < retries[j].ID })
+
+	return retries
+}
+
+// RetryNow retries a waiting delivery without waiting for its delay.
+func (w *Watch) RetryNow(id uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	retry, ok := w.retryQueue[id]
+	if !ok {
+		return fmt.Errorf("No retry with id %d", id)
+	}
+
+	select {
+	case retry.now <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// DeadLetters returns the messages whose delivery failed, oldest first.
+func (w *Watch) DeadLetters() []DeadLetter {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]DeadLetter{}, w.deadLetters...)
+}
+
+// Replay removes a message from the dead letters and delivers it again.
+func (w *Watch) Replay(id uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopped {
+		return fmt.Errorf("Watch is stopped")
+	}
+
+	for i, dl := range w.deadLetters {
+		if dl.ID == id {
+			w.deadLetters = append(w.deadLetters[:i], w.deadLetters[i+1:]...)
+			// a new trace, linked to the failed one
+			ctx, _ := tracing.Tracer().Start(w.ctx, "replay",
+				trace.WithLinks(trace.Link{SpanContext: dl.span}),
+				trace.WithAttributes(
+					tracing.ACCOUNT.String(dl.msg.Account),
+					tracing.MAILBOX.String(dl.msg.Mailbox),
+					tracing.UID.Int64(int64(dl.UID))))
+			w.wg.Add(1)
+			go func() {
+				defer w.wg.Done()
+				w.deliverChain(ctx, dl.msg, dl.from, true)
+			}()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("No dead letter with id %d", id)
+}
+
+// History returns the most recent deliveries, oldest first.
+func (w *Watch) History() []Delivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]Delivery{}, w.history...)
+}
+
+func (w *Watch) addRetry(retry *Retry) {
+	w.mu.Lock()
+	w.seq++
+	retry.ID = w.seq
+	retry.now = make(chan struct{}, 1)
+	w.retryQueue[retry.ID] = retry
+	w.mu.Unlock()
+}
+
+func (w *Watch) removeRetry(retry *Retry) {
+	w.mu.Lock()
+	delete(w.retryQueue, retry.ID)
+	w.mu.Unlock()
+}
+
+func (w *Watch) addDeadLetter(dl DeadLetter) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.seq++
+	dl.ID = w.seq
+	if len(w.deadLetters) >= DEAD_LETTERS_SIZE {
+		dropped := w.deadLetters[0]
+		w.logger.Warn("dead letters full, dropping the oldest", "uid", dropped.UID, "message-id", dropped.MessageId)
+		w.deadLetters = w.deadLetters[1:]
+	}
+	w.deadLetters = append(w.deadLetters, dl)
+}
+
+func (w *Watch) addHistory(delivery Delivery) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.history) >= HISTORY_SIZE {
+		w.history = w.history[1:]
+	}
+	w.history = append(w.history, delivery)
+}
+
+func messageId(msg *handler.Message) string {
+	header, err := msg.Header()
+	if err != nil {
+		return ""
+	}
+
+	return header.Get("Message-Id")
+}
@@ -0,0 +1,72 @@
+package watch
+
+import (
+	"context"
+	"time"
+
+	"github.com/etrepat/postman/handler"
+)
+
+// Status is a snapshot of the state of a watch.
+type Status struct {
+	Account   string `json:"account"`
+	Mailbox   string `json:"mailbox"`
+	Connected bool   `json:"connected"`
+	Selected  bool   `json:"selected"`
+	// last successful IDLE (or NOOP while the delivery queue is full)
+	// round-trip with the server
+	LastIdle time.Time `json:"last_idle"`
+	// messages fetched and waiting for delivery
+	Queued        int `json:"queued"`
+	QueueCapacity int `json:"queue_capacity"`
+	// unseen messages left on the server as the delivery queue is full
+	Pending     int  `json:"pending"`
+	Paused      bool `json:"paused"`
+	Retrying    int  `json:"retrying"`
+	DeadLetters int  `json:"dead_letters"`
+}
+
+// HandlerCheck is the result of checking the target of a handler.
+type HandlerCheck struct {
+	Name        string
+	Description string
+	Err         error
+}
+
+// Status returns the current state of the watch.
+func (w *Watch) Status() Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := w.status
+	status.Account = w.client.Username
+	status.Mailbox = w.mailbox
+	status.Queued = len(w.chMsgs)
+	status.QueueCapacity = cap(w.chMsgs)
+	status.Retrying = len(w.retryQueue)
+	status.DeadLetters = len(w.deadLetters)
+
+	return status
+}
+
+// CheckHandlers checks that the target of every handler of the chain can be
+// reached.
+func (w *Watch) CheckHandlers(ctx context.Context) []HandlerCheck {
+	handlers, names, release := w.useChain()
+	defer release()
+	checks := make([]HandlerCheck, len(handlers))
+	for i, hnd := range handlers {
+		checks[i] = HandlerCheck{
+			Name:        names[i],
+			Description: hnd.Describe(),
+			Err:         handler.Check(ctx, hnd)}
+	}
+
+	return checks
+}
+
+func (w *Watch) updateStatus(update func(status *Status)) {
+	w.mu.Lock()
+	update(&w.status)
+	w.mu.Unlock()
+}
@@ -1,14 +1,26 @@
 package watch
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/mail"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/etrepat/postman/handler"
 	"github.com/etrepat/postman/imap"
+	"github.com/etrepat/postman/metrics"
+	"github.com/etrepat/postman/oauth"
+	"github.com/etrepat/postman/secret"
+	"github.com/etrepat/postman/tracing"
 	"github.com/etrepat/postman/version"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -16,41 +28,164 @@ const (
 	DELIVERY_MODE_LOGGER   = "logger"
 	DELIVERY_MODE_SMART    = "smart"
 	DELIVERY_MODE_HIPCHAT  = "hipchat"
+	DELIVERY_MODE_FORWARD  = "forward"
+	DELIVERY_MODE_ARCHIVE  = "archive"
+	DELIVERY_MODE_EXEC     = "exec"
+	DELIVERY_MODE_AMQP     = "amqp"
+	DELIVERY_MODE_NATS     = "nats"
+	DELIVERY_MODE_KAFKA    = "kafka"
+	DELIVERY_MODE_S3       = "s3"
+
+	ORDER_NONE   = "none"
+	ORDER_SENDER = "sender"
+	ORDER_THREAD = "thread"
+
+	// delay before reconnecting to the server, doubled on each failure
+	RECONNECT_MIN_DELAY = time.Second
+	RECONNECT_MAX_DELAY = 5 * time.Minute
+
+	// consecutive failed IMAP commands after which the connection is taken
+	// for lost, and opened again
+	MAX_COMMAND_FAILURES = 3
 )
 
 var (
-	DefaultLogger  = log.New(os.Stdout, "[watch] ", log.LstdFlags)
 	DELIVERY_MODES = map[string]bool{
 		DELIVERY_MODE_POSTBACK: true,
 		DELIVERY_MODE_LOGGER:   true,
 		DELIVERY_MODE_SMART:    true,
-		DELIVERY_MODE_HIPCHAT:  true}
+		DELIVERY_MODE_HIPCHAT:  true,
+		DELIVERY_MODE_FORWARD:  true,
+		DELIVERY_MODE_ARCHIVE:  true,
+		DELIVERY_MODE_EXEC:     true,
+		DELIVERY_MODE_AMQP:     true,
+		DELIVERY_MODE_NATS:     true,
+		DELIVERY_MODE_KAFKA:    true,
+		DELIVERY_MODE_S3:       true}
+	ORDERINGS = map[string]bool{
+		ORDER_NONE:   true,
+		ORDER_SENDER: true,
+		ORDER_THREAD: true}
 )
 
 type Flags struct {
-	Host          string
-	Port          uint
-	Ssl           bool
-	Username      string
-	Password      string
-	Mailbox       string
-	Mode          string
-	PostbackUrl   string
-	PostEncoded   bool
-	PostParamName string
-	RoomAuth      string
-	RoomName      string
-	RoomColor     string
+	Host           string
+	Port           uint
+	Ssl            bool
+	Username       string
+	Password       string
+	Mailbox        string
+	Mode           string
+	PostbackUrl    string
+	PostEncoded    bool
+	PostParamName  string
+	RoomAuth       string
+	RoomName       string
+	RoomColor      string
+	RoomFormat     string
+	SmtpHost       string
+	SmtpPort       uint
+	SmtpUsername   string
+	SmtpPassword   string
+	SmtpTlsMode    string
+	ForwardFrom    string
+	ForwardTo      []string
+	ForwardStyle   string
+	ArchivePath    string
+	ArchiveFormat  string
+	ArchiveRotate  string
+	ArchiveGzip    bool
+	ExecCommand    string
+	ExecTimeout    time.Duration
+	ExecWorkers    int
+	QueueUrl       string
+	QueueTopic     string
+	QueueKey       string
+	QueueFormat    string
+	S3Endpoint     string
+	S3Ssl          bool
+	S3Region       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3Bucket       string
+	Retries        uint
+	RetryDelay     time.Duration
+	HandlerTimeout time.Duration
+	MessageTimeout time.Duration
+	StopTimeout    time.Duration
+	Workers        int
+	Prefetch       int
+	Order          string
+	// maximum concurrent deliveries per delivery mode
+	Concurrency map[string]int
+
+	// oauth2 authentication, instead of password, when a provider is set
+	OAuthProvider     string
+	OAuthClientId     string
+	OAuthClientSecret string
+	OAuthTenant       string
+	OAuthTokenFile    string
+
+	// password sources, read again on each connection
+	PasswordFile    string
+	PasswordCommand string
+
+	// sasl authentication
+	AuthMechanism string
+	AuthIdentity  string
+
+	// tls
+	TlsMode       string
+	TlsCAFile     string
+	TlsServerName string
+	TlsMinVersion string
+	TlsPins       []string
+	TlsCert       string
+	TlsKey        string
+
+	// interval between checks for new messages, when the server does not
+	// support IDLE
+	PollInterval time.Duration
+
+	// IDLE renewal and NOOP keepalive intervals, see imap.ImapClient
+	IdleInterval time.Duration
+	KeepAlive    time.Duration
 }
 
 type Watch struct {
-	mailbox  string
-	handlers []handler.MessageHandler
-	client   *imap.ImapClient
-	logger   *log.Logger
-	chMsgs   chan string
-	done     chan bool
-	wg       sync.WaitGroup
+	mailbox        string
+	handlers       []handler.ContextHandler
+	names          []string
+	inflight       *sync.WaitGroup
+	client         *imap.ImapClient
+	logger         *slog.Logger
+	retries        uint
+	retryDelay     time.Duration
+	handlerTimeout time.Duration
+	messageTimeout time.Duration
+	stopTimeout    time.Duration
+	workers        int
+	prefetch       int
+	order          string
+	pollInterval   time.Duration
+	idleInterval   time.Duration
+	polling        bool
+	once           bool
+	chMsgs         chan *imap.Message
+	freed          chan struct{}
+	connects       int
+	mu             sync.Mutex
+	status         Status
+	woken          chan struct{}
+	seq            uint64
+	retryQueue     map[uint64]*Retry
+	deadLetters    []DeadLetter
+	history        []Delivery
+	stopped        bool
+	done           chan bool
+	ctx            context.Context
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
 }
 
 func (w *Watch) Mailbox() string {
@@ -61,151 +196,931 @@ func (w *Watch) SetMailbox(value string) {
 	w.mailbox = value
 }
 
-func (w *Watch) SetLogger(logger *log.Logger) {
-	w.logger = logger
+// SetLogger sets the logger of the watch, of its IMAP connection and of its
+// deliveries. Log entries carry the account and mailbox.
+func (w *Watch) SetLogger(logger *slog.Logger) {
+	w.logger = logger.With("account", w.client.Username, "mailbox", w.mailbox)
+	w.client.Logger = w.logger
 }
 
-func (w *Watch) Logger() *log.Logger {
+func (w *Watch) Logger() *slog.Logger {
 	return w.logger
 }
 
-func (w *Watch) AddHandler(handler handler.MessageHandler) {
-	w.handlers = append(w.handlers, handler)
+// SetRetries sets how many times a temporary delivery failure is retried, and
+// the delay before the first retry. The delay doubles on every attempt.
+func (w *Watch) SetRetries(retries uint, delay time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.retries = retries
+	w.retryDelay = delay
 }
 
-func (w *Watch) Handlers() []handler.MessageHandler {
-	return w.handlers
+func (w *Watch) Retries() uint {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.retries
 }
 
-func (w *Watch) Start() {
-	w.logger.Println("Starting ", version.VersionShort())
+// SetTimeouts sets the maximum duration of a single handler delivery attempt,
+// of the whole delivery chain of a message (retries included), and how long
+// Stop waits for in-flight deliveries before cancelling them. Zero means no
+// limit.
+func (w *Watch) SetTimeouts(handlerTimeout time.Duration, messageTimeout time.Duration, stopTimeout time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	w.chMsgs = make(chan string, 3)
-	w.done = make(chan bool)
+	w.handlerTimeout = handlerTimeout
+	w.messageTimeout = messageTimeout
+	w.stopTimeout = stopTimeout
+}
 
-	w.wg.Add(1)
-	go w.handleIncoming()
+// SetWorkers sets how many messages are delivered at once, and how many
+// messages are fetched ahead of delivery. With an order other than
+// ORDER_NONE, messages from the same sender or thread are delivered one at a
+// time, in the order they were fetched.
+func (w *Watch) SetWorkers(workers int, prefetch int, order string) {
+	if workers < 1 {
+		workers = 1
+	}
+	if prefetch < 1 {
+		prefetch = 1
+	}
+
+	w.workers = workers
+	w.prefetch = prefetch
+	w.order = order
+}
+
+// AddHandler appends a handler to the delivery chain. Handlers also
+// implementing handler.Handler are given the Message, others the raw message.
+func (w *Watch) AddHandler(hnd handler.MessageHandler) {
+	w.AddNamedHandler(strings.TrimPrefix(fmt.Sprintf("%T", hnd), "*"), handler.Adapt(hnd))
+}
+
+// AddNamedHandler appends a handler to the delivery chain, reporting its
+// metrics under name. Handlers only implementing handler.Handler are added
+// this way.
+func (w *Watch) AddNamedHandler(name string, hnd handler.Handler) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.handlers = append(w.handlers, handler.AdaptContext(hnd))
+	w.names = append(w.names, name)
+}
+
+func (w *Watch) Handlers() []handler.ContextHandler {
+	handlers, _ := w.chain()
+
+	return handlers
+}
+
+// chain returns the delivery chain and the names of its handlers. Reload
+// replaces them rather than changing them in place.
+func (w *Watch) chain() ([]handler.ContextHandler, []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.handlers, w.names
+}
+
+// useChain returns the delivery chain like chain, along with the function to
+// call once done with it. Reload closes a replaced chain once every user is
+// done with it.
+func (w *Watch) useChain() ([]handler.ContextHandler, []string, func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	w.logger.Printf("Handling incoming messages with:")
-	for i := 0; i < len(w.handlers); i++ {
-		w.logger.Printf("> %s", w.handlers[i].Describe())
+	inflight := w.inflight
+	inflight.Add(1)
+
+	return w.handlers, w.names, inflight.Done
+}
+
+// closeChain closes the handlers of a chain once its deliveries are done.
+func (w *Watch) closeChain(handlers []handler.ContextHandler, names []string, inflight *sync.WaitGroup) {
+	inflight.Wait()
+
+	for i, hnd := range handlers {
+		if err := handler.Close(hnd); err != nil {
+			w.logger.Warn("could not close handler", "handler", names[i], "error", err)
+		}
+	}
+}
+
+// Reload replaces the delivery chain, retries and timeouts with those of
+// flags, without dropping the IMAP connection. Nothing changes when the chain
+// of flags can not be built. Deliveries in progress go on with the previous
+// chain, closed once they are done. Connection, mailbox and worker settings
+// only change on restart.
+func (w *Watch) Reload(flags *Flags) error {
+	handlers, names, err := newHandlers(flags)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	previous, previousNames, inflight := w.handlers, w.names, w.inflight
+	w.handlers = handlers
+	w.names = names
+	w.inflight = &sync.WaitGroup{}
+	w.mu.Unlock()
+
+	go w.closeChain(previous, previousNames, inflight)
+
+	w.SetRetries(flags.Retries, flags.RetryDelay)
+	w.SetTimeouts(flags.HandlerTimeout, flags.MessageTimeout, flags.StopTimeout)
+
+	for i := range handlers {
+		w.logger.Info("handling incoming messages", "handler", names[i], "description", handlers[i].Describe())
 	}
+
+	return nil
+}
+
+func (w *Watch) Start() {
+	w.begin()
+
 	w.wg.Add(1)
 	err := w.monitorMailbox()
 	if err != nil {
-		w.logger.Fatalln(err)
+		w.logger.Error("watch failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// RunOnce delivers the unseen messages of the mailbox, and returns once they
+// are all delivered or dead letters, rather than waiting for new ones. It
+// returns the IMAP error which stopped it, if any.
+func (w *Watch) RunOnce() error {
+	w.once = true
+	w.begin()
+
+	w.wg.Add(1)
+	err := w.monitorMailbox()
+	w.wg.Wait()
+	w.cancel()
+
+	return err
+}
+
+// begin starts the delivery workers.
+func (w *Watch) begin() {
+	w.logger.Info("starting", "version", version.VersionShort())
+
+	w.mu.Lock()
+	w.chMsgs = make(chan *imap.Message, w.prefetch)
+	w.mu.Unlock()
+	w.freed = make(chan struct{}, 1)
+	w.done = make(chan bool)
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	w.wg.Add(1)
+	go w.handleIncoming()
+
+	handlers, names := w.chain()
+	for i := range handlers {
+		w.logger.Info("handling incoming messages", "handler", names[i], "description", handlers[i].Describe())
 	}
 }
 
 func (w *Watch) Stop() {
+	w.mu.Lock()
+	w.stopped = true
+	stopTimeout := w.stopTimeout
+	w.mu.Unlock()
+
 	close(w.done)
-	log.Printf("Waiting for termination ==> maximum %d minutes", imap.IdleTimeout/time.Minute)
+	w.wake()
+	w.logger.Info("waiting for termination", "max", w.idleInterval)
+
+	// in-flight deliveries still running after stopTimeout get cancelled
+	if stopTimeout > 0 {
+		timer := time.AfterFunc(stopTimeout, w.cancel)
+		defer timer.Stop()
+	}
 	w.wg.Wait()
+	w.cancel()
+
+	w.Close()
 
 	// Stop close imap connection only when the program enter a waiting state
 
 }
 
+// Close closes the delivery chain once its deliveries are done. Stop closes
+// it, runs which do not watch the mailbox, ie: RunOnce, Backfill or Deliver,
+// close it once done.
+func (w *Watch) Close() {
+	w.mu.Lock()
+	handlers, names, inflight := w.handlers, w.names, w.inflight
+	w.mu.Unlock()
+
+	w.closeChain(handlers, names, inflight)
+}
+
+// handleIncoming delivers fetched messages with a pool of workers. When
+// ordering is on, a dispatcher routes all messages of a sender or thread to
+// the same worker, and never waits for a busy worker: up to workers times
+// prefetch messages queue for their worker while the others go on delivering.
+// Past that, the dispatcher stops taking messages, and fetching waits as it
+// does when the delivery queue is full.
 func (w *Watch) handleIncoming() {
-	var err error
+	defer w.wg.Done()
+
 	var wg sync.WaitGroup
-	for message := range w.chMsgs {
-
-		wg.Add(1)
-		go func(m string) {
-			for _, handler := range w.handlers {
-				err = handler.Deliver(m)
-				if err != nil {
-					w.logger.Println(err)
-				} else {
-					w.logger.Println("Delivered successfully")
+	if w.order == "" || w.order == ORDER_NONE {
+		for i := 0; i < w.workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for m := range w.chMsgs {
+					w.taken()
+					ctx, msg := w.newMessage(m)
+					w.deliverChain(ctx, msg, 0, false)
+				}
+			}()
+		}
+	} else {
+		// every queue can hold all the queued messages, so that handing a
+		// message to a worker never blocks
+		max := w.workers * w.prefetch
+		started := make(chan struct{}, max)
+		queues := make([]chan incoming, w.workers)
+		for i := range queues {
+			queues[i] = make(chan incoming, max)
+			wg.Add(1)
+			go func(queue chan incoming) {
+				defer wg.Done()
+				for in := range queue {
+					started <- struct{}{}
+					w.deliverChain(in.ctx, in.msg, 0, false)
+				}
+			}(queues[i])
+		}
+
+		queued := 0
+		for msgs := w.chMsgs; msgs != nil; {
+			in := msgs
+			if queued >= max {
+				in = nil
+			}
+
+			select {
+			case m, ok := <-in:
+				if !ok {
+					msgs = nil
+					continue
 				}
+				w.taken()
+				ctx, msg := w.newMessage(m)
+				hash := fnv.New32a()
+				hash.Write([]byte(orderingKey(msg, w.order)))
+				queues[hash.Sum32()%uint32(w.workers)] <- incoming{ctx, msg}
+				queued++
+			case <-started:
+				queued--
 			}
-			wg.Done()
-		}(message)
+		}
+
+		for _, queue := range queues {
+			close(queue)
+		}
 	}
 	wg.Wait()
-	log.Printf("quitting handleIncomming")
-	w.wg.Done()
+	w.logger.Debug("deliveries done")
 }
 
+// taken signals monitorMailbox that there is room for more messages.
+func (w *Watch) taken() {
+	select {
+	case w.freed <- struct{}{}:
+	default:
+	}
+}
+
+// incoming is a message on its way to delivery, along with the context
+// carrying its trace.
+type incoming struct {
+	ctx context.Context
+	msg *handler.Message
+}
+
+// newMessage starts the trace of a fetched message, which goes back to the
+// start of its FETCH command, and parses it.
+func (w *Watch) newMessage(m *imap.Message) (context.Context, *handler.Message) {
+	msg := handler.NewMessage(m.Raw)
+	msg.UID = m.UID
+	msg.Mailbox = w.mailbox
+	msg.Account = w.client.Username
+
+	tracer := tracing.Tracer()
+	ctx, _ := tracer.Start(w.ctx, "message",
+		trace.WithTimestamp(m.FetchStart),
+		trace.WithAttributes(
+			tracing.ACCOUNT.String(msg.Account),
+			tracing.MAILBOX.String(msg.Mailbox),
+			tracing.UID.Int64(int64(msg.UID))))
+
+	_, span := tracer.Start(ctx, "fetch", trace.WithTimestamp(m.FetchStart))
+	span.End(trace.WithTimestamp(m.FetchEnd))
+
+	_, span = tracer.Start(ctx, "parse")
+	if _, err := msg.Header(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "parse failed")
+	}
+	span.End()
+
+	return ctx, msg
+}
+
+// Deliver hands a message which does not come from the watched mailbox, ie:
+// read from a file, to the delivery chain, and returns the error of the
+// failing handler, if any.
+func (w *Watch) Deliver(ctx context.Context, msg *handler.Message) error {
+	if msg.Mailbox == "" {
+		msg.Mailbox = w.mailbox
+	}
+	if msg.Account == "" {
+		msg.Account = w.client.Username
+	}
+
+	ctx, _ = tracing.Tracer().Start(ctx, "message",
+		trace.WithAttributes(
+			tracing.ACCOUNT.String(msg.Account),
+			tracing.MAILBOX.String(msg.Mailbox)))
+
+	return w.deliverChain(ctx, msg, 0, false)
+}
+
+// deliverChain hands the message to every handler in turn, starting with the
+// handler at index from. The chain stops at the first failing handler, as the
+// next ones may rely on its results, and the message becomes a dead letter,
+// whose error is returned. The span of ctx, if any, ends along.
+func (w *Watch) deliverChain(ctx context.Context, msg *handler.Message, from int, replayed bool) error {
+	span := trace.SpanFromContext(ctx)
+	defer span.End()
+
+	w.mu.Lock()
+	messageTimeout := w.messageTimeout
+	w.mu.Unlock()
+	if messageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, messageTimeout)
+		defer cancel()
+	}
+
+	delivery := Delivery{
+		UID:       msg.UID,
+		MessageId: messageId(msg),
+		Started:   time.Now(),
+		Replayed:  replayed}
+	defer func() {
+		delivery.Duration = time.Since(delivery.Started)
+		w.addHistory(delivery)
+	}()
+
+	logger := w.logger.With("uid", msg.UID, "message-id", delivery.MessageId)
+	ctx = handler.WithLogger(ctx, logger)
+	span.SetAttributes(tracing.MESSAGE_ID.String(delivery.MessageId))
+
+	handlers, names, release := w.useChain()
+	defer release()
+	for i := from; i < len(handlers); i++ {
+		err := w.deliver(ctx, names[i], handlers[i], msg)
+		if err != nil {
+			span.SetStatus(codes.Error, "delivery failed")
+			logger.Error("delivery failed", "handler", names[i], "duration", time.Since(delivery.Started), "error", err)
+			delivery.Handler = names[i]
+			delivery.Error = err.Error()
+			w.addDeadLetter(DeadLetter{
+				UID:       msg.UID,
+				MessageId: delivery.MessageId,
+				Handler:   names[i],
+				Error:     err.Error(),
+				Failed:    time.Now(),
+				msg:       msg,
+				from:      i,
+				span:      span.SpanContext()})
+			return fmt.Errorf("%s: %s", names[i], err)
+		}
+	}
+
+	logger.Info("delivered", "duration", time.Since(delivery.Started), "replayed", replayed)
+
+	return nil
+}
+
+// deliver hands the message to hnd, retrying temporary failures with an
+// exponential backoff until retries are exhausted, ctx is done or the watch
+// is stopped. An attempt running over the handler timeout is a temporary
+// failure.
+func (w *Watch) deliver(ctx context.Context, name string, hnd handler.ContextHandler, msg *handler.Message) error {
+	ctx, span := tracing.Tracer().Start(ctx, "handler "+name, trace.WithAttributes(tracing.HANDLER.String(name)))
+	defer span.End()
+
+	w.mu.Lock()
+	retries, delay := w.retries, w.retryDelay
+	w.mu.Unlock()
+
+	for attempt := uint(0); ; attempt++ {
+		logger := handler.Logger(ctx).With("handler", name, "attempt", attempt+1)
+		actx, aspan := tracing.Tracer().Start(ctx, "attempt", trace.WithAttributes(tracing.ATTEMPT.Int(int(attempt+1))))
+		start := time.Now()
+		err := w.attempt(handler.WithLogger(actx, logger), hnd, msg)
+		metrics.Delivered(name, outcome(err), time.Since(start))
+		if err != nil {
+			aspan.RecordError(err)
+			aspan.SetStatus(codes.Error, outcome(err))
+		}
+		aspan.End()
+
+		logger = logger.With("duration", time.Since(start))
+		if err == nil {
+			logger.Debug("handler delivered")
+		}
+		if err == nil || !handler.IsTemporary(err) || attempt >= retries {
+			if err != nil {
+				span.SetStatus(codes.Error, outcome(err))
+			}
+			return err
+		}
+
+		logger.Warn("temporary delivery failure", "error", err, "retry_in", delay)
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("delay", delay.String())))
+		retry := &Retry{
+			UID:       msg.UID,
+			MessageId: messageId(msg),
+			Handler:   name,
+			Attempt:   attempt + 1,
+			Error:     err.Error(),
+			Next:      time.Now().Add(delay)}
+		if !w.wait(ctx, retry, delay) {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// wait waits for a retry, and reports whether the delivery may go on.
+func (w *Watch) wait(ctx context.Context, retry *Retry, delay time.Duration) bool {
+	metrics.RetryQueueDepth.Inc()
+	defer metrics.RetryQueueDepth.Dec()
+	w.addRetry(retry)
+	defer w.removeRetry(retry)
+
+	select {
+	case <-time.After(delay):
+		return true
+	case <-retry.now:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-w.done:
+		return false
+	}
+}
+
+func outcome(err error) string {
+	if err == nil {
+		return metrics.OUTCOME_SUCCESS
+	} else if handler.IsTemporary(err) {
+		return metrics.OUTCOME_TEMPORARY
+	}
+
+	return metrics.OUTCOME_PERMANENT
+}
+
+func (w *Watch) attempt(ctx context.Context, hnd handler.ContextHandler, msg *handler.Message) error {
+	w.mu.Lock()
+	timeout := w.handlerTimeout
+	w.mu.Unlock()
+
+	if timeout == 0 {
+		return hnd.DeliverContext(ctx, msg)
+	}
+
+	actx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// an abandoned delivery may still succeed, retrying it could deliver twice
+	err := hnd.DeliverContext(actx, msg)
+	if err != nil && actx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		if handler.IsAbandoned(err) {
+			return fmt.Errorf("timed out after %s: %s", timeout, err)
+		}
+		return handler.Temporary(fmt.Errorf("timed out after %s: %s", timeout, err))
+	}
+
+	return err
+}
+
+// monitorMailbox watches the mailbox until stopped. A failed or lost
+// connection is opened again, after a delay doubled on each failure. Until
+// the mailbox was first selected, configuration errors (ie: invalid
+// credentials) are returned rather than retried; in once mode, any error is.
 func (w *Watch) monitorMailbox() error {
 	defer w.wg.Done()
+	defer close(w.chMsgs)
 
+	selected := false
+	delay := RECONNECT_MIN_DELAY
+	for {
+		start := time.Now()
+		ok, err := w.session()
+		selected = selected || ok
+		if err == nil || w.once || (!selected && imap.IsConfigError(err)) {
+			return err
+		}
+
+		// a connection which lasted was not a failed one
+		if time.Since(start) > RECONNECT_MAX_DELAY {
+			delay = RECONNECT_MIN_DELAY
+		}
+		w.logger.Warn("reconnecting", "error", err, "delay", delay)
+
+		select {
+		case <-w.done:
+			return nil
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > RECONNECT_MAX_DELAY {
+			delay = RECONNECT_MAX_DELAY
+		}
+	}
+}
+
+// session connects, selects the mailbox and fetches messages as they arrive
+// until stopped, or until the connection is lost, which it returns. It
+// reports whether the mailbox was selected.
+func (w *Watch) session() (bool, error) {
 	var err error
 
-	w.logger.Printf("Initiating connection to %s", w.client.Addr())
+	w.logger.Info("connecting", "server", w.client.Addr())
 	err = w.client.Connect()
 	if err != nil {
-		return err
+		return false, err
+	}
+	if w.connects++; w.connects > 1 {
+		metrics.ImapReconnects.WithLabelValues(w.mailbox).Inc()
 	}
+	w.updateStatus(func(status *Status) { status.Connected = true })
 
-	defer log.Println("Disconnected from IMAP Server " + w.client.Addr())
+	defer w.logger.Info("disconnected", "server", w.client.Addr())
+	defer w.updateStatus(func(status *Status) {
+		status.Connected = false
+		status.Selected = false
+	})
 	defer w.client.Disconnect()
 
-	w.logger.Printf("Switching to %s", w.mailbox)
+	w.logger.Info("selecting mailbox")
 	err = w.client.Select(w.mailbox)
 	if err != nil {
-		return err
+		return false, err
 	}
+	w.updateStatus(func(status *Status) {
+		status.Selected = true
+		status.LastIdle = time.Now()
+	})
 
-	w.logger.Printf("Checking for new (unseen) messages")
-	err = w.client.Unseen(w.chMsgs)
-	if err != nil {
-		return err
+	idle := w.client.SupportsIdle()
+	if !idle && !w.once {
+		w.logger.Warn("IMAP server does not support IDLE, polling", "interval", w.pollInterval)
+	}
+	w.mu.Lock()
+	w.polling = !idle
+	w.mu.Unlock()
+
+	// the connection is quiet while the delivery queue is full
+	keepAlive := w.idleInterval
+	if w.client.KeepAlive > 0 && w.client.KeepAlive < keepAlive {
+		keepAlive = w.client.KeepAlive
+	}
+
+	// commands failing again and again are taken for a lost connection,
+	// rather than retried right away forever
+	failures := 0
+	failed := func(err error) error {
+		if failures++; failures < MAX_COMMAND_FAILURES {
+			return nil
+		}
+		return fmt.Errorf("%d IMAP commands failed in a row, last: %s", failures, err)
 	}
 
-L:
+	w.logger.Info("checking for new (unseen) messages")
+
 	for {
 		select {
 		case <-w.done:
-			close(w.chMsgs)
-			log.Printf("closing w.chMsgs")
-			break L
+			w.logger.Debug("stopped fetching messages")
+			return true, nil
 		default:
 		}
-		w.logger.Printf("Waiting for new messages")
-		w.client.Incoming(w.chMsgs)
+
+		// only fetch what the delivery queue can take, so that the IMAP
+		// connection never blocks on it
+		var fetched, pending int
+		if !w.Status().Paused {
+			fetched, pending, err = w.client.Fetch(w.chMsgs, cap(w.chMsgs)-len(w.chMsgs))
+			if err != nil && w.once {
+				return true, err
+			} else if lost := w.lost(err); lost != nil {
+				return true, lost
+			} else if err != nil {
+				w.logger.Error("fetch failed", "error", err)
+				if lost := failed(err); lost != nil {
+					return true, lost
+				}
+			} else if fetched > 0 {
+				w.logger.Debug("fetched messages", "count", fetched)
+			}
+			metrics.MessagesFetched.WithLabelValues(w.mailbox).Add(float64(fetched))
+			w.updateStatus(func(status *Status) { status.Pending = pending })
+		}
+
+		if pending > 0 {
+			w.logger.Info("delivery queue full", "pending", pending)
+			select {
+			case <-w.freed:
+			case <-w.woken:
+			case <-w.done:
+			case <-time.After(keepAlive):
+				err = w.client.Noop()
+				if lost := w.lost(err); lost != nil {
+					return true, lost
+				} else if err != nil {
+					w.logger.Error("noop failed", "error", err)
+					if lost := failed(err); lost != nil {
+						return true, lost
+					}
+				} else {
+					failures = 0
+					metrics.IdleSucceeded(w.mailbox)
+					w.updateStatus(func(status *Status) { status.LastIdle = time.Now() })
+				}
+			}
+			continue
+		}
+
+		if w.once {
+			w.logger.Info("no more unseen messages")
+			return true, nil
+		}
+
+		w.logger.Debug("waiting for new messages")
+		if idle {
+			_, err = w.client.Idle(w.woken)
+		} else {
+			_, err = w.client.Poll(w.woken, w.pollInterval)
+		}
+		if lost := w.lost(err); lost != nil {
+			return true, lost
+		} else if err != nil {
+			w.logger.Error("idle failed", "error", err)
+			if lost := failed(err); lost != nil {
+				return true, lost
+			}
+		} else {
+			failures = 0
+			metrics.IdleSucceeded(w.mailbox)
+			w.updateStatus(func(status *Status) { status.LastIdle = time.Now() })
+		}
 	}
+}
 
-	return nil
+// lost returns why the connection can no longer be used after the command
+// which failed with err, or nil when err is nil or the connection is usable.
+func (w *Watch) lost(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return w.client.Unavailable()
+}
+
+// IdleInterval returns the longest expected time between two successful
+// round-trips with the server: the IDLE interval, or the poll interval when
+// the server does not support IDLE.
+func (w *Watch) IdleInterval() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.polling && w.pollInterval > w.idleInterval {
+		return w.pollInterval
+	}
+
+	return w.idleInterval
+}
+
+// orderingKey returns the key of the messages to be delivered in order: the
+// sender address, or the thread root Message-Id.
+func orderingKey(msg *handler.Message, order string) string {
+	header, err := msg.Header()
+	if err != nil {
+		return ""
+	}
+
+	switch order {
+	case ORDER_SENDER:
+		if addr, err := mail.ParseAddress(header.Get("From")); err == nil {
+			return strings.ToLower(addr.Address)
+		}
+		return header.Get("From")
+	case ORDER_THREAD:
+		if refs := strings.Fields(header.Get("References")); len(refs) > 0 {
+			return refs[0]
+		}
+		if parent := strings.TrimSpace(header.Get("In-Reply-To")); parent != "" {
+			return parent
+		}
+		return header.Get("Message-Id")
+	}
+
+	return ""
+}
+
+// OAuthConfig returns the oauth2 client, or nil without provider.
+func (f *Flags) OAuthConfig() *oauth.Config {
+	if f.OAuthProvider == "" {
+		return nil
+	}
+
+	return &oauth.Config{
+		Provider:     f.OAuthProvider,
+		ClientId:     f.OAuthClientId,
+		ClientSecret: f.OAuthClientSecret,
+		Tenant:       f.OAuthTenant,
+		TokenFile:    f.OAuthTokenFile}
+}
+
+// Modes returns the delivery modes of the chain, in order.
+func (f *Flags) Modes() []string {
+	modes := []string{}
+	for _, mode := range strings.Split(f.Mode, ",") {
+		if mode = strings.TrimSpace(mode); mode != "" {
+			modes = append(modes, mode)
+		}
+	}
+
+	return modes
+}
+
+// HasMode reports whether mode is part of the delivery chain.
+func (f *Flags) HasMode(mode string) bool {
+	for _, m := range f.Modes() {
+		if m == mode {
+			return true
+		}
+	}
+
+	return false
 }
 
 func NewFlags() *Flags {
 	return &Flags{}
 }
 
-func New(flags *Flags, handlers ...handler.MessageHandler) *Watch {
+// New returns the watch of the mailbox of flags, delivering to handlers, or to
+// the chain of the modes of flags when none are given.
+func New(flags *Flags, handlers ...handler.MessageHandler) (*Watch, error) {
 	watch := &Watch{
-		mailbox: flags.Mailbox,
-		client:  imap.NewClient(flags.Host, flags.Port, flags.Ssl, flags.Username, flags.Password),
-		logger:  DefaultLogger}
+		mailbox:    flags.Mailbox,
+		client:     NewClient(flags),
+		woken:      make(chan struct{}, 1),
+		inflight:   &sync.WaitGroup{},
+		retryQueue: map[uint64]*Retry{}}
+
+	watch.SetLogger(slog.Default())
+
+	watch.SetRetries(flags.Retries, flags.RetryDelay)
+	watch.SetTimeouts(flags.HandlerTimeout, flags.MessageTimeout, flags.StopTimeout)
+	watch.SetWorkers(flags.Workers, flags.Prefetch, flags.Order)
+	watch.pollInterval = flags.PollInterval
+	watch.idleInterval = flags.IdleInterval
+	if watch.idleInterval <= 0 {
+		watch.idleInterval = imap.IdleTimeout
+	}
 
 	if len(handlers) != 0 {
 		for _, hnd := range handlers {
 			watch.AddHandler(hnd)
 		}
 	} else {
-		switch flags.Mode {
-		case DELIVERY_MODE_POSTBACK:
-			watch.AddHandler(handler.New(handler.POSTBACK_HANDLER, flags.PostbackUrl, flags.PostEncoded, flags.PostParamName))
+		var err error
+		watch.handlers, watch.names, err = newHandlers(flags)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return watch, nil
+}
+
+// NewClient returns the IMAP client of the account of flags, not yet
+// connected.
+func NewClient(flags *Flags) *imap.ImapClient {
+	client := imap.NewClient(flags.Host, flags.Port, flags.Ssl, flags.Username, flags.Password)
+
+	if flags.PasswordFile != "" || flags.PasswordCommand != "" {
+		client.PasswordSource = secret.New(flags.Password, flags.PasswordFile, flags.PasswordCommand)
+	}
+	client.Mechanism = flags.AuthMechanism
+	client.Identity = flags.AuthIdentity
+	client.TLSMode = flags.TlsMode
+	client.CAFile = flags.TlsCAFile
+	client.ServerName = flags.TlsServerName
+	client.MinVersion, _ = imap.TLSVersion(flags.TlsMinVersion)
+	client.Pins = flags.TlsPins
+	client.CertFile = flags.TlsCert
+	client.KeyFile = flags.TlsKey
+	client.IdleInterval = flags.IdleInterval
+	client.KeepAlive = flags.KeepAlive
+	if config := flags.OAuthConfig(); config != nil {
+		client.TokenSource = oauth.NewTokenSource(config)
+	}
+
+	return client
+}
 
-		case DELIVERY_MODE_LOGGER:
-			watch.AddHandler(handler.New(handler.LOGGER_HANDLER, DefaultLogger))
-		case DELIVERY_MODE_SMART:
-			watch.AddHandler(handler.New(handler.SMART_HANDLER))
-		case DELIVERY_MODE_HIPCHAT:
-			watch.AddHandler(handler.New(handler.HIPCHAT_HANDLER, flags.RoomAuth, flags.RoomName, flags.RoomColor))
+// CheckChain makes sure the delivery chain of the modes of flags can be
+// built, without connecting to anything. The chain is closed right away.
+func CheckChain(flags *Flags) error {
+	handlers, _, err := newHandlers(flags)
+	if err != nil {
+		return err
+	}
+	closeHandlers(handlers)
+
+	return nil
+}
+
+// newHandlers returns the delivery chain of the modes of flags, and the
+// names of its handlers. The handlers already built are closed when one of
+// them can not be.
+func newHandlers(flags *Flags) ([]handler.ContextHandler, []string, error) {
+	handlers := []handler.ContextHandler{}
+	names := []string{}
+	for _, mode := range flags.Modes() {
+		hnd, err := newHandler(mode, flags)
+		if err != nil {
+			closeHandlers(handlers)
+			return nil, nil, fmt.Errorf("%s mode: %s", mode, err)
 		}
+		limited := handler.Limit(handler.AdaptContext(handler.Adapt(hnd)), flags.Concurrency[mode])
+		handlers = append(handlers, limited)
+		names = append(names, mode)
 	}
 
-	return watch
+	return handlers, names, nil
+}
+
+// closeHandlers closes handlers which were never used to deliver messages.
+func closeHandlers(handlers []handler.ContextHandler) {
+	for _, hnd := range handlers {
+		handler.Close(hnd)
+	}
+}
+
+func newHandler(mode string, flags *Flags) (handler.MessageHandler, error) {
+	switch mode {
+	case DELIVERY_MODE_POSTBACK:
+		return handler.New(handler.POSTBACK_HANDLER, flags.PostbackUrl, flags.PostEncoded, flags.PostParamName)
+	case DELIVERY_MODE_LOGGER:
+		return handler.New(handler.LOGGER_HANDLER)
+	case DELIVERY_MODE_SMART:
+		return handler.New(handler.SMART_HANDLER)
+	case DELIVERY_MODE_HIPCHAT:
+		return handler.New(handler.HIPCHAT_HANDLER, flags.RoomAuth, flags.RoomName, flags.RoomColor, flags.RoomFormat)
+	case DELIVERY_MODE_FORWARD:
+		return handler.New(handler.FORWARD_HANDLER, flags.SmtpHost, flags.SmtpPort, flags.SmtpUsername, flags.SmtpPassword, flags.ForwardFrom, flags.ForwardTo, flags.ForwardStyle, flags.SmtpTlsMode)
+	case DELIVERY_MODE_ARCHIVE:
+		return handler.New(handler.ARCHIVE_HANDLER, flags.ArchivePath, flags.ArchiveFormat, flags.ArchiveRotate, flags.ArchiveGzip)
+	case DELIVERY_MODE_EXEC:
+		return handler.New(handler.EXEC_HANDLER, flags.ExecCommand, flags.Mailbox, flags.ExecTimeout, flags.ExecWorkers)
+	case DELIVERY_MODE_AMQP:
+		return handler.New(handler.AMQP_HANDLER, flags.QueueUrl, flags.QueueTopic, flags.QueueKey, flags.QueueFormat)
+	case DELIVERY_MODE_NATS:
+		return handler.New(handler.NATS_HANDLER, flags.QueueUrl, flags.QueueTopic, flags.QueueKey, flags.QueueFormat)
+	case DELIVERY_MODE_KAFKA:
+		return handler.New(handler.KAFKA_HANDLER, flags.QueueUrl, flags.QueueTopic, flags.QueueKey, flags.QueueFormat)
+	case DELIVERY_MODE_S3:
+		return handler.New(handler.S3_HANDLER, flags.S3Endpoint, flags.S3Ssl, flags.S3Region, flags.S3AccessKey, flags.S3SecretKey, flags.S3Bucket, flags.Username, flags.Mailbox)
+	}
+
+	return nil, fmt.Errorf("unknown delivery mode %s", mode)
 }
 
 func DeliveryModeValid(mode string) bool {
 	return DELIVERY_MODES[mode]
 }
 
+func OrderValid(order string) bool {
+	return ORDERINGS[order]
+}
+
 func ValidDeliveryModes() []string {
 	modes := make([]string, len(DELIVERY_MODES))
 	i := 0
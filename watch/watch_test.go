@@ -0,0 +1,184 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etrepat/postman/handler"
+	"github.com/etrepat/postman/imap"
+	"github.com/etrepat/postman/redact"
+)
+
+const testMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: support@example.com\r\n" +
+	"Subject: Printer on fire\r\n" +
+	"Message-Id: <1234@example.com>\r\n" +
+	"\r\n" +
+	"It is still burning.\r\n"
+
+// stringHandler only implements handler.MessageHandler, as handlers written
+// before the Message type do.
+type stringHandler struct {
+	messages []string
+}
+
+func (h *stringHandler) Deliver(message string) error {
+	h.messages = append(h.messages, message)
+	return nil
+}
+
+func (h *stringHandler) Describe() string {
+	return "string handler"
+}
+
+func newTestWatch(t *testing.T, handlers ...handler.MessageHandler) *Watch {
+	t.Helper()
+
+	w, err := New(&Flags{Host: "imap.example.com", Port: 993, Username: "support@example.com", Mailbox: "INBOX"}, handlers...)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	return w
+}
+
+func TestWatchMessageHandlers(t *testing.T) {
+	first, second := &stringHandler{}, &stringHandler{}
+	w := newTestWatch(t, first)
+	w.AddHandler(second)
+
+	if err := w.Deliver(context.Background(), handler.NewMessage([]byte(testMessage))); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+
+	for i, hnd := range []*stringHandler{first, second} {
+		if len(hnd.messages) != 1 || hnd.messages[0] != testMessage {
+			t.Errorf("handler %d got %q, want the raw message", i, hnd.messages)
+		}
+	}
+
+	handlers := w.Handlers()
+	if len(handlers) != 2 || handlers[0].Describe() != "string handler" {
+		t.Errorf("Handlers() = %v", handlers)
+	}
+}
+
+// blockingHandler holds the messages of the blocked sender until released.
+type blockingHandler struct {
+	blocked   string
+	release   chan struct{}
+	delivered chan string
+}
+
+func (h *blockingHandler) DeliverMessage(msg *handler.Message) error {
+	header, _ := msg.Header()
+	if header.Get("From") == h.blocked {
+		<-h.release
+	}
+	h.delivered <- header.Get("From") + " " + header.Get("Subject")
+
+	return nil
+}
+
+func (h *blockingHandler) Describe() string {
+	return "blocking handler"
+}
+
+// TestWatchOrderedDispatch checks that the messages of a sender waiting for a
+// busy worker do not hold up those of other senders.
+func TestWatchOrderedDispatch(t *testing.T) {
+	const workers, prefetch = 2, 2
+
+	worker := func(sender string) uint32 {
+		hash := fnv.New32a()
+		hash.Write([]byte(sender))
+		return hash.Sum32() % workers
+	}
+	slow, fast := "slow@example.com", ""
+	for i := 0; fast == ""; i++ {
+		if sender := fmt.Sprintf("fast%d@example.com", i); worker(sender) != worker(slow) {
+			fast = sender
+		}
+	}
+
+	hnd := &blockingHandler{blocked: slow, release: make(chan struct{}), delivered: make(chan string, 10)}
+	w := newTestWatch(t)
+	w.SetWorkers(workers, prefetch, ORDER_SENDER)
+	w.AddNamedHandler("blocking", hnd)
+	w.begin()
+
+	// more messages of the slow sender than a worker queue used to hold
+	go func() {
+		for i, sender := range []string{slow, slow, slow, slow, fast} {
+			raw := fmt.Sprintf("From: %s\r\nSubject: %d\r\n\r\nbody\r\n", sender, i)
+			w.chMsgs <- &imap.Message{UID: uint32(i + 1), Raw: []byte(raw)}
+		}
+	}()
+
+	select {
+	case got := <-hnd.delivered:
+		if got != fast+" 4" {
+			t.Fatalf("delivered %q first, want the message of %s", got, fast)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the message of %s is held up by those of %s", fast, slow)
+	}
+
+	close(hnd.release)
+	for i := 0; i < 4; i++ {
+		if got := <-hnd.delivered; got != fmt.Sprintf("%s %d", slow, i) {
+			t.Errorf("delivered %q, want %s %d in order", got, slow, i)
+		}
+	}
+
+	close(w.chMsgs)
+	w.wg.Wait()
+}
+
+func TestWatchLoggerHashesAccount(t *testing.T) {
+	redact.HashAddresses = true
+	defer func() { redact.HashAddresses = false }()
+
+	var buf bytes.Buffer
+	w := newTestWatch(t)
+	w.SetLogger(slog.New(redact.NewHandler(slog.NewTextHandler(&buf, nil))))
+	w.Logger().Info("connecting")
+
+	if strings.Contains(buf.String(), "support@example.com") {
+		t.Errorf("account logged in clear: %s", buf.String())
+	}
+	if want := "account=" + redact.Address("support@example.com"); !strings.Contains(buf.String(), want) {
+		t.Errorf("log entry does not contain %q: %s", want, buf.String())
+	}
+}
+
+// closingHandler records whether it was closed.
+type closingHandler struct {
+	stringHandler
+	closed bool
+}
+
+func (h *closingHandler) Close() error {
+	h.closed = true
+	return nil
+}
+
+func TestWatchClose(t *testing.T) {
+	hnd := &closingHandler{}
+	w := newTestWatch(t, hnd)
+
+	if err := w.Deliver(context.Background(), handler.NewMessage([]byte(testMessage))); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	w.Close()
+
+	if !hnd.closed {
+		t.Errorf("handler was not closed")
+	}
+}